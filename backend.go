@@ -0,0 +1,152 @@
+package localdiscovery
+
+import (
+	"context"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+)
+
+// Backend is a source of containers served by the discover API.
+// Implementations must be safe for concurrent use.
+// See DockerDiscovery, StaticBackend and MemoryBackend.
+type Backend interface {
+	// Lookup looks up the given port of the caller container and enforces the given health requirement.
+	// The port may omit the protocol, tcp is assumed.
+	Lookup(ctx context.Context, caller Caller, port string, health discoverclient.HealthRequirement) (*discoverclient.LookupResponse, error)
+	// Self returns the details of the caller container.
+	Self(caller Caller) (*discoverclient.ContainerInfo, error)
+	// ListContainers returns the details of all the containers.
+	ListContainers() ([]discoverclient.ContainerInfo, error)
+	// Health reports the backend health.
+	// Fails with a backend_unavailable API error when the backend can't serve the lookups.
+	Health() (*discoverclient.HealthResponse, error)
+	// Watch returns a channel signaled upon container changes until ctx is done.
+	// Consecutive changes may be coalesced in a single signal. The channel is never closed.
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// validateHealth checks the given health requirement.
+func validateHealth(health discoverclient.HealthRequirement) error {
+	if health != discoverclient.HealthIgnore && health != discoverclient.HealthFail && health != discoverclient.HealthWait {
+		return apiError(discoverclient.CodeBadRequest, "invalid health requirement %q", health)
+	}
+	return nil
+}
+
+// enforceHealth applies the given health requirement to the lookup response of a cached container.
+// With discoverclient.HealthWait, waits for the container to be healthy for a while
+// or until the context is done.
+// Returns a container_unhealthy API error when the container is not healthy.
+func enforceHealth(ctx context.Context, cache *containerCache, resp *discoverclient.LookupResponse, health discoverclient.HealthRequirement) (*discoverclient.LookupResponse, error) {
+	if health == discoverclient.HealthIgnore || isHealthy(resp.Health) {
+		return resp, nil
+	}
+	unhealthyErr := func() error {
+		return apiError(discoverclient.CodeContainerUnhealthy, "container %s is %s", resp.Container, resp.Health)
+	}
+	if health == discoverclient.HealthFail {
+		return nil, unhealthyErr()
+	}
+
+	timeout := time.NewTimer(healthWaitTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, unhealthyErr()
+		case <-timeout.C:
+			return nil, unhealthyErr()
+		case <-ticker.C:
+		}
+		cont, ok := cache.get(resp.Container)
+		if !ok {
+			return nil, apiError(discoverclient.CodeContainerNotFound, "container %s stopped", resp.Container)
+		}
+		if resp.Health = containerHealth(cont); isHealthy(resp.Health) {
+			return cache.portResponse(cont, resp.Network, resp.Port)
+		}
+	}
+}
+
+// cacheBackend serves the lookups from a container cache.
+// Shared by the backends without docker.
+type cacheBackend struct {
+	// TrustPolicy defines how the callers are identified. Defaults to TrustRemote.
+	// Must be set before serving lookups.
+	TrustPolicy TrustPolicy
+
+	cache *containerCache
+}
+
+// lookupContainer looks up the cached container of the given caller.
+func (b *cacheBackend) lookupContainer(caller Caller) (Match, error) {
+	m, ok, err := b.cache.match(caller, b.TrustPolicy)
+	if err != nil {
+		return Match{}, err
+	}
+	if !ok {
+		return Match{}, apiError(discoverclient.CodeContainerNotFound, "unable to lookup container %s", caller)
+	}
+	return m, nil
+}
+
+// Lookup implements Backend.
+func (b *cacheBackend) Lookup(ctx context.Context, caller Caller, port string, health discoverclient.HealthRequirement) (*discoverclient.LookupResponse, error) {
+	if err := validateHealth(health); err != nil {
+		return nil, err
+	}
+	port, err := normalizePort(port)
+	if err != nil {
+		return nil, err
+	}
+	m, err := b.lookupContainer(caller)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.cache.portResponse(m.Container, m.Network, port)
+	if err != nil {
+		return nil, err
+	}
+	return enforceHealth(ctx, b.cache, resp, health)
+}
+
+// Self implements Backend.
+func (b *cacheBackend) Self(caller Caller) (*discoverclient.ContainerInfo, error) {
+	m, err := b.lookupContainer(caller)
+	if err != nil {
+		return nil, err
+	}
+	return b.cache.containerInfo(m.Container, m.Network)
+}
+
+// ListContainers implements Backend.
+func (b *cacheBackend) ListContainers() ([]discoverclient.ContainerInfo, error) {
+	return listContainers(b.cache)
+}
+
+// Health implements Backend. The cache is always available.
+func (b *cacheBackend) Health() (*discoverclient.HealthResponse, error) {
+	return &discoverclient.HealthResponse{Status: discoverclient.StatusOK}, nil
+}
+
+// Watch implements Backend.
+func (b *cacheBackend) Watch(ctx context.Context) <-chan struct{} {
+	return b.cache.subscribe(ctx)
+}
+
+// listContainers returns the details of all the cached containers.
+func listContainers(cache *containerCache) ([]discoverclient.ContainerInfo, error) {
+	conts := cache.list()
+	infos := make([]discoverclient.ContainerInfo, 0, len(conts))
+	for _, cont := range conts {
+		info, err := cache.containerInfo(cont, "")
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
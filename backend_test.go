@@ -0,0 +1,251 @@
+package localdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	_ Backend = (*DockerDiscovery)(nil)
+	_ Backend = (*StaticBackend)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+)
+
+func TestMemoryBackendRouter(t *testing.T) {
+	backend := NewMemoryBackend()
+	if err := backend.Set(StaticContainer{
+		ID:       "web",
+		Name:     "web",
+		Networks: map[string]string{"bridge": "192.0.2.1"},
+		Ports: map[string][]string{
+			"80":      {"32768", "127.0.0.1:8080"},
+			"443/tcp": {},
+		},
+	}, StaticContainer{
+		ID:       "db",
+		Networks: map[string]string{"bridge": "192.0.2.2"},
+		Ports:    map[string][]string{"5432": {"5432"}},
+		Health:   discoverclient.HealthStarting,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(backend)
+
+	get := func(path, remoteAddr string, out interface{}) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+			t.Fatalf("Invalid response for %s: %s", path, err)
+		}
+		return w.Code
+	}
+
+	for _, tc := range []struct {
+		path, remoteAddr string
+		code             int
+		state            discoverclient.PortState
+		bindings         int
+	}{
+		{path: "/v1/self/ports/80", remoteAddr: "192.0.2.1:1234", code: http.StatusOK, state: discoverclient.PortPublished, bindings: 2},
+		{path: "/v1/self/ports/443", remoteAddr: "192.0.2.1:1234", code: http.StatusOK, state: discoverclient.PortUnpublished},
+		{path: "/v1/self/ports/81", remoteAddr: "192.0.2.1:1234", code: http.StatusNotFound},
+		{path: "/v1/self/ports/80", remoteAddr: "192.0.2.3:1234", code: http.StatusNotFound},
+		{path: "/v1/self/ports/5432", remoteAddr: "192.0.2.2:1234", code: http.StatusOK, state: discoverclient.PortPublished, bindings: 1},
+		{path: "/v1/self/ports/5432?health=fail", remoteAddr: "192.0.2.2:1234", code: http.StatusConflict},
+	} {
+		var resp discoverclient.LookupResponse
+		if code := get(tc.path, tc.remoteAddr, &resp); code != tc.code {
+			t.Fatalf("Unexpected status code for %s from %s.\nExpected: %d\nGot:      %d", tc.path, tc.remoteAddr, tc.code, code)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if resp.State != tc.state || len(resp.Bindings) != tc.bindings {
+			t.Fatalf("Unexpected response for %s: %+v", tc.path, resp)
+		}
+	}
+
+	var info discoverclient.ContainerInfo
+	if code := get("/v1/self", "192.0.2.1:1234", &info); code != http.StatusOK || info.ID != "web" || info.Name != "web" || len(info.Ports) != 2 {
+		t.Fatalf("Unexpected self: %d %+v", code, info)
+	}
+	var infos []discoverclient.ContainerInfo
+	if code := get("/v1/containers", "", &infos); code != http.StatusOK || len(infos) != 2 {
+		t.Fatalf("Unexpected containers: %d %+v", code, infos)
+	}
+	var health discoverclient.HealthResponse
+	if code := get("/v1/health", "", &health); code != http.StatusOK || health.Status != discoverclient.StatusOK {
+		t.Fatalf("Unexpected health: %d %+v", code, health)
+	}
+	// Metrics are only exposed by the docker backend.
+	var errResp discoverclient.ErrorResponse
+	if code := get("/metrics", "", &errResp); code != http.StatusNotFound {
+		t.Fatalf("Unexpected metrics status code: %d", code)
+	}
+}
+
+func TestMemoryBackendWatch(t *testing.T) {
+	backend := NewMemoryBackend()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := backend.Watch(ctx)
+
+	expectChange := func() {
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for change")
+		}
+	}
+	if err := backend.Set(StaticContainer{ID: "web", Networks: map[string]string{"bridge": "192.0.2.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectChange()
+	backend.Remove("web")
+	expectChange()
+	if infos, err := backend.ListContainers(); err != nil || len(infos) != 0 {
+		t.Fatalf("Unexpected containers after removal: %v (%v)", infos, err)
+	}
+
+	if err := backend.Set(StaticContainer{ID: "web", Networks: map[string]string{"bridge": "nope"}}); err == nil {
+		t.Fatal("Expected error for invalid IP")
+	}
+	if err := backend.Set(StaticContainer{ID: "web", Ports: map[string][]string{"80": {"0"}}}); err == nil {
+		t.Fatal("Expected error for invalid binding")
+	}
+}
+
+func TestStaticBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	for _, tc := range []struct {
+		name, content string
+	}{
+		{name: "mapping.yaml", content: `
+containers:
+  - id: web
+    hostname: web
+    mac: 02:42:ac:11:00:02
+    networks: {bridge: 172.17.0.2, v6: "fd00::2"}
+    ports:
+      80/tcp: ["32768"]
+      53/udp: ["[::1]:5353"]
+`},
+		{name: "mapping.json", content: `{"containers": [{
+  "id": "web",
+  "hostname": "web",
+  "mac": "02:42:ac:11:00:02",
+  "networks": {"bridge": "172.17.0.2", "v6": "fd00::2"},
+  "ports": {"80/tcp": ["32768"], "53/udp": ["[::1]:5353"]}
+}]}`},
+	} {
+		path := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		backend, err := NewStaticBackend(path)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", tc.name, err)
+		}
+		for _, caller := range []Caller{{RemoteIP: "172.17.0.2"}, {RemoteIP: "fd00::2"}} {
+			resp, err := backend.Lookup(context.Background(), caller, "53/udp", discoverclient.HealthIgnore)
+			if err != nil {
+				t.Fatalf("Unexpected error for %s from %s: %s", tc.name, caller, err)
+			}
+			if len(resp.Bindings) != 1 || resp.Bindings[0].HostIP != "::1" || resp.Bindings[0].HostPort != 5353 {
+				t.Fatalf("Unexpected response for %s: %+v", tc.name, resp)
+			}
+		}
+		backend.TrustPolicy = TrustHints
+		if _, err := backend.Self(Caller{MAC: "02:42:ac:11:00:02"}); err != nil {
+			t.Fatalf("Unexpected error for %s by MAC: %s", tc.name, err)
+		}
+
+		// An invalid file keeps the previous content.
+		if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.Reload(); err == nil {
+			t.Fatalf("Expected error reloading invalid %s", tc.name)
+		}
+		if infos, err := backend.ListContainers(); err != nil || len(infos) != 1 {
+			t.Fatalf("Unexpected containers after invalid reload of %s: %v (%v)", tc.name, infos, err)
+		}
+	}
+}
+
+func TestEnforceHealth(t *testing.T) {
+	cache := newContainerCache()
+	setHealth := func(health string) {
+		cont := fakeContainer("a", "172.17.0.2")
+		cont.NetworkSettings.Ports = map[docker.Port][]docker.PortBinding{"80/tcp": {{HostIP: "0.0.0.0", HostPort: "8080"}}}
+		cont.State.Health.Status = health
+		cache.set(cont)
+	}
+	lookup := func(ctx context.Context, health discoverclient.HealthRequirement) (*discoverclient.LookupResponse, error) {
+		cont, ok := cache.get("a")
+		if !ok {
+			t.Fatal("Container a not found in cache")
+		}
+		resp, err := cache.portResponse(cont, "bridge", "80/tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enforceHealth(ctx, cache, resp, health)
+	}
+
+	setHealth("starting")
+	if resp, err := lookup(context.Background(), discoverclient.HealthIgnore); err != nil || resp.Health != discoverclient.HealthStarting {
+		t.Fatalf("Unexpected response without health requirement: %+v (%v)", resp, err)
+	}
+	_, err := lookup(context.Background(), discoverclient.HealthFail)
+	expectAPIError(t, err, discoverclient.CodeContainerUnhealthy)
+
+	// Waits until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*healthPollInterval)
+	defer cancel()
+	start := time.Now()
+	_, err = lookup(ctx, discoverclient.HealthWait)
+	expectAPIError(t, err, discoverclient.CodeContainerUnhealthy)
+	if elapsed := time.Since(start); elapsed < 2*healthPollInterval || elapsed > healthWaitTimeout {
+		t.Fatalf("Unexpected wait: %s", elapsed)
+	}
+
+	// Waits until the container is healthy.
+	go func() {
+		time.Sleep(healthPollInterval)
+		setHealth("healthy")
+	}()
+	resp, err := lookup(context.Background(), discoverclient.HealthWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Health != discoverclient.HealthHealthy || len(resp.Bindings) != 1 || resp.Bindings[0].HostPort != 8080 {
+		t.Fatalf("Unexpected response once healthy: %+v", resp)
+	}
+
+	// Fails when the container stops while waiting.
+	setHealth("unhealthy")
+	go func() {
+		time.Sleep(healthPollInterval)
+		cache.remove("a")
+	}()
+	_, err = lookup(context.Background(), discoverclient.HealthWait)
+	expectAPIError(t, err, discoverclient.CodeContainerNotFound)
+}
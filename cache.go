@@ -0,0 +1,408 @@
+package localdiscovery
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// defaultNetwork is the network name used for the legacy top level IPAddress.
+const defaultNetwork = "bridge"
+
+// Match is a container matched by IP.
+type Match struct {
+	Container *docker.Container
+	Network   string // Name of the network the IP belongs to.
+}
+
+// matches sorts the Matches by network name then container ID
+// so the lookups are deterministic when an IP is present on multiple networks.
+type matches []Match
+
+func (m matches) Len() int      { return len(m) }
+func (m matches) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m matches) Less(i, j int) bool {
+	if m[i].Network != m[j].Network {
+		return m[i].Network < m[j].Network
+	}
+	return m[i].Container.ID < m[j].Container.ID
+}
+
+// containersByName sorts the containers by name then ID.
+type containersByName []*docker.Container
+
+func (c containersByName) Len() int      { return len(c) }
+func (c containersByName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c containersByName) Less(i, j int) bool {
+	if c[i].Name != c[j].Name {
+		return c[i].Name < c[j].Name
+	}
+	return c[i].ID < c[j].ID
+}
+
+// containerCache is an in-memory index of the running containers of all the docker endpoints.
+// It is safe for concurrent use.
+type containerCache struct {
+	mu         sync.RWMutex
+	containers map[string]*docker.Container // Keyed by container ID.
+	byIP       map[string]matches           // Keyed by container IP, sorted.
+	services   map[string]*swarm.Service    // Swarm service of the task containers, keyed by container ID.
+	endpoints  map[string]string            // Docker endpoint name of the containers, keyed by container ID.
+	updated    map[string]time.Time         // Last full reconciliation, keyed by docker endpoint name.
+
+	subMu       sync.Mutex
+	subscribers map[chan struct{}]struct{} // Signaled upon cache update.
+}
+
+func newContainerCache() *containerCache {
+	return &containerCache{
+		containers: map[string]*docker.Container{},
+		byIP:       map[string]matches{},
+		services:   map[string]*swarm.Service{},
+		endpoints:  map[string]string{},
+		updated:    map[string]time.Time{},
+
+		subscribers: map[chan struct{}]struct{}{},
+	}
+}
+
+// notify signals a cache update to the subscribers without blocking.
+func (c *containerCache) notify() {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	for ch := range c.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel signaled upon cache update until ctx is done.
+// Consecutive updates may be coalesced in a single signal. The channel is never closed.
+func (c *containerCache) subscribe(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	c.subMu.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.subMu.Unlock()
+	go func() {
+		<-ctx.Done()
+		c.subMu.Lock()
+		delete(c.subscribers, ch)
+		c.subMu.Unlock()
+	}()
+	return ch
+}
+
+// watchers returns the number of subscribers.
+func (c *containerCache) watchers() int {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	return len(c.subscribers)
+}
+
+// set adds or replaces the given container in the cache.
+func (c *containerCache) set(cont *docker.Container) {
+	c.setTask("", cont, nil)
+}
+
+// setTask adds or replaces the given container of the given docker endpoint in the cache
+// along with its swarm service. svc is nil for the standalone containers.
+func (c *containerCache) setTask(endpoint string, cont *docker.Container, svc *swarm.Service) {
+	c.mu.Lock()
+	c.unindex(cont.ID)
+	c.index(endpoint, cont)
+	if svc != nil {
+		c.services[cont.ID] = svc
+	}
+	c.mu.Unlock()
+	c.notify()
+}
+
+// remove drops the given container ID from the cache.
+func (c *containerCache) remove(id string) {
+	c.mu.Lock()
+	c.unindex(id)
+	c.mu.Unlock()
+	c.notify()
+}
+
+// replace discards the cache content and indexes the given containers.
+func (c *containerCache) replace(containers []*docker.Container) {
+	c.replaceTasks("", containers, nil)
+}
+
+// replaceTasks discards the cache content of the given docker endpoint and indexes the given containers
+// along with the swarm services of the tasks, keyed by container ID.
+func (c *containerCache) replaceTasks(endpoint string, containers []*docker.Container, services map[string]*swarm.Service) {
+	c.mu.Lock()
+	for id, name := range c.endpoints {
+		if name == endpoint {
+			c.unindex(id)
+		}
+	}
+	for _, cont := range containers {
+		c.unindex(cont.ID)
+		c.index(endpoint, cont)
+		if svc, ok := services[cont.ID]; ok {
+			c.services[cont.ID] = svc
+		}
+	}
+	c.updated[endpoint] = time.Now()
+	c.mu.Unlock()
+	c.notify()
+}
+
+// lookupIP returns the container owning the given IPv4 or IPv6.
+// When the IP is present on multiple networks of a docker endpoint, the first network
+// in lexical order wins.
+// When the IP is present on several docker endpoints, ex: rootless daemons sharing
+// the default bridge subnet, the caller hostname hint selects the container.
+// The MAC hint only tells them apart when the containers have custom MAC addresses:
+// docker derives the default one from the IP.
+// Returns an ambiguous_caller API error if the hints don't settle it.
+func (c *containerCache) lookupIP(ip string, caller Caller) (Match, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.byIP[normalizeIP(ip)]
+	if !ok {
+		return Match{}, false, nil
+	}
+	if c.sameEndpoint(m) {
+		return m[0], true, nil
+	}
+	candidates := c.filterHints(m, caller)
+	if len(candidates) == 0 || !c.sameEndpoint(candidates) {
+		return Match{}, false, apiError(discoverclient.CodeAmbiguousCaller,
+			"ip %s matches containers of docker endpoints %s", normalizeIP(ip), strings.Join(c.matchEndpoints(m), ", "))
+	}
+	return candidates[0], true, nil
+}
+
+// sameEndpoint checks if the given matches belong to a single docker endpoint. Expects the lock to be held.
+func (c *containerCache) sameEndpoint(m matches) bool {
+	return len(c.matchEndpoints(m)) <= 1
+}
+
+// matchEndpoints returns the sorted names of the docker endpoints of the given matches.
+// Expects the lock to be held.
+func (c *containerCache) matchEndpoints(m matches) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, elem := range m {
+		if name := c.endpoints[elem.Container.ID]; !seen[name] {
+			seen[name] = true
+			names = append(names, strconv.Quote(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filterHints keeps the matches agreeing with the caller MAC and hostname hints, when set.
+func (c *containerCache) filterHints(m matches, caller Caller) matches {
+	var kept matches
+	for _, elem := range m {
+		if caller.MAC != "" && !strings.EqualFold(matchMAC(elem), normalizeMAC(caller.MAC)) {
+			continue
+		}
+		if caller.Hostname != "" && (elem.Container.Config == nil || elem.Container.Config.Hostname != caller.Hostname) {
+			continue
+		}
+		kept = append(kept, elem)
+	}
+	return kept
+}
+
+// matchMAC returns the hardware address of the container on the matched network.
+func matchMAC(m Match) string {
+	if m.Container.NetworkSettings == nil {
+		return ""
+	}
+	if network, ok := m.Container.NetworkSettings.Networks[m.Network]; ok {
+		return network.MacAddress
+	}
+	return m.Container.NetworkSettings.MacAddress
+}
+
+// normalizeMAC returns the canonical form of the given hardware address, as is if invalid.
+func normalizeMAC(mac string) string {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return mac
+	}
+	return hwAddr.String()
+}
+
+// list returns the cached containers sorted by name.
+func (c *containerCache) list() []*docker.Container {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	conts := make(containersByName, 0, len(c.containers))
+	for _, cont := range c.containers {
+		conts = append(conts, cont)
+	}
+	sort.Sort(conts)
+	return conts
+}
+
+// get returns the cached container of the given ID.
+func (c *containerCache) get(id string) (*docker.Container, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cont, ok := c.containers[id]
+	return cont, ok
+}
+
+// service returns the swarm service of the given container ID, nil if it is not a swarm task.
+func (c *containerCache) service(id string) *swarm.Service {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.services[id]
+}
+
+// size returns the number of cached containers.
+func (c *containerCache) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.containers)
+}
+
+// endpoint returns the docker endpoint name of the given container ID.
+func (c *containerCache) endpoint(id string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.endpoints[id]
+}
+
+// lastUpdate returns the time of the oldest full reconciliation of the docker endpoints.
+func (c *containerCache) lastUpdate() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var oldest time.Time
+	for _, updated := range c.updated {
+		if oldest.IsZero() || updated.Before(oldest) {
+			oldest = updated
+		}
+	}
+	return oldest
+}
+
+// lastEndpointUpdate returns the time of the last full reconciliation of the given docker endpoint.
+func (c *containerCache) lastEndpointUpdate(endpoint string) time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.updated[endpoint]
+}
+
+// portResponse builds the lookup response of the given cached container port.
+// See portResponse.
+func (c *containerCache) portResponse(cont *docker.Container, network, port string) (*discoverclient.LookupResponse, error) {
+	resp, err := portResponse(cont, c.service(cont.ID), network, port)
+	if err != nil {
+		return nil, err
+	}
+	resp.Endpoint = c.endpoint(cont.ID)
+	return resp, nil
+}
+
+// containerInfo returns the details of the given cached container.
+// See containerInfo.
+func (c *containerCache) containerInfo(cont *docker.Container, network string) (*discoverclient.ContainerInfo, error) {
+	info, err := containerInfo(cont, c.service(cont.ID), network)
+	if err != nil {
+		return nil, err
+	}
+	info.Endpoint = c.endpoint(cont.ID)
+	for i := range info.Ports {
+		info.Ports[i].Endpoint = info.Endpoint
+	}
+	return info, nil
+}
+
+// networkIP is an IP of a container on a given network.
+type networkIP struct {
+	Network string
+	IP      string
+}
+
+// normalizeIP returns the canonical form of the given IP, without zone.
+// IPv4-mapped IPv6 addresses are converted to IPv4.
+// Returns the input as is if it is not a valid IP.
+func normalizeIP(ip string) string {
+	if i := strings.LastIndex(ip, "%"); i != -1 {
+		ip = ip[:i]
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	return parsed.String()
+}
+
+// containerIPs returns the IPv4 and global IPv6 addresses of the container on all its networks.
+func containerIPs(cont *docker.Container) []networkIP {
+	var ips []networkIP
+	if cont.NetworkSettings == nil {
+		return ips
+	}
+	add := func(network string, addrs ...string) {
+		for _, ip := range addrs {
+			if ip != "" {
+				ips = append(ips, networkIP{Network: network, IP: normalizeIP(ip)})
+			}
+		}
+	}
+	for name, network := range cont.NetworkSettings.Networks {
+		add(name, network.IPAddress, network.GlobalIPv6Address)
+	}
+	// Older docker API only populate the top level addresses.
+	if len(cont.NetworkSettings.Networks) == 0 {
+		add(defaultNetwork, cont.NetworkSettings.IPAddress, cont.NetworkSettings.GlobalIPv6Address)
+	}
+	return ips
+}
+
+// index adds the container of the given docker endpoint to the maps. Expects the lock to be held.
+func (c *containerCache) index(endpoint string, cont *docker.Container) {
+	c.containers[cont.ID] = cont
+	c.endpoints[cont.ID] = endpoint
+	for _, addr := range containerIPs(cont) {
+		m := append(c.byIP[addr.IP], Match{Container: cont, Network: addr.Network})
+		sort.Sort(m)
+		c.byIP[addr.IP] = m
+	}
+}
+
+// unindex removes the container from the maps. Expects the lock to be held.
+func (c *containerCache) unindex(id string) {
+	cont, ok := c.containers[id]
+	if !ok {
+		return
+	}
+	delete(c.containers, id)
+	delete(c.services, id)
+	delete(c.endpoints, id)
+	for _, addr := range containerIPs(cont) {
+		ip := addr.IP
+		m := c.byIP[ip][:0:0]
+		for _, elem := range c.byIP[ip] {
+			if elem.Container.ID != id {
+				m = append(m, elem)
+			}
+		}
+		if len(m) == 0 {
+			delete(c.byIP, ip)
+			continue
+		}
+		c.byIP[ip] = m
+	}
+}
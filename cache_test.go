@@ -0,0 +1,92 @@
+package localdiscovery
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestContainerCacheNetworks(t *testing.T) {
+	cache := newContainerCache()
+	cache.replace([]*docker.Container{
+		{ID: "web", NetworkSettings: &docker.NetworkSettings{Networks: map[string]docker.ContainerNetwork{
+			"bridge":   {IPAddress: "172.17.0.2"},
+			"frontend": {IPAddress: "10.1.0.2"},
+			"backend":  {IPAddress: "10.2.0.2"},
+		}}},
+		// Same IP on two user-defined networks.
+		{ID: "db", NetworkSettings: &docker.NetworkSettings{Networks: map[string]docker.ContainerNetwork{
+			"zeta":  {IPAddress: "10.3.0.3"},
+			"alpha": {IPAddress: "10.3.0.3"},
+		}}},
+		// Older docker API without the per network settings.
+		{ID: "legacy", NetworkSettings: &docker.NetworkSettings{IPAddress: "172.17.0.4"}},
+		{ID: "none"},
+	})
+
+	for _, tc := range []struct {
+		ip      string
+		expect  string // Container ID, empty for not found.
+		network string
+	}{
+		{ip: "172.17.0.2", expect: "web", network: "bridge"},
+		{ip: "10.1.0.2", expect: "web", network: "frontend"},
+		{ip: "10.2.0.2", expect: "web", network: "backend"},
+		{ip: "10.3.0.3", expect: "db", network: "alpha"},
+		{ip: "172.17.0.4", expect: "legacy", network: "bridge"},
+		{ip: "10.9.0.9"},
+	} {
+		m, ok, err := cache.lookupIP(tc.ip, Caller{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", tc.ip, err)
+		}
+		if tc.expect == "" {
+			if ok {
+				t.Fatalf("Unexpected match for %s: %s", tc.ip, m.Container.ID)
+			}
+			continue
+		}
+		if !ok || m.Container.ID != tc.expect || m.Network != tc.network {
+			t.Fatalf("Unexpected match for %s.\nExpected: %s (%s)\nGot:      %+v", tc.ip, tc.expect, tc.network, m)
+		}
+	}
+
+	// All the networks of a removed container are dropped.
+	cache.remove("web")
+	for _, ip := range []string{"172.17.0.2", "10.1.0.2", "10.2.0.2"} {
+		if _, ok, _ := cache.lookupIP(ip, Caller{}); ok {
+			t.Fatalf("Unexpected match for %s after removal", ip)
+		}
+	}
+	if _, ok, _ := cache.lookupIP("10.3.0.3", Caller{}); !ok {
+		t.Fatal("Expected the other containers to be kept")
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip, expect string
+	}{
+		{ip: "10.0.0.2", expect: "10.0.0.2"},
+		{ip: "::ffff:10.0.0.2", expect: "10.0.0.2"},
+		{ip: "fd00:0:0::2", expect: "fd00::2"},
+		{ip: "FD00::2", expect: "fd00::2"},
+		{ip: "fe80::1%eth0", expect: "fe80::1"},
+		{ip: "nope", expect: "nope"},
+	} {
+		if got := normalizeIP(tc.ip); got != tc.expect {
+			t.Fatalf("Unexpected normalized ip for %s.\nExpected: %s\nGot:      %s", tc.ip, tc.expect, got)
+		}
+	}
+
+	// The IPv6 addresses of the containers are indexed.
+	cache := newContainerCache()
+	cache.set(&docker.Container{ID: "web", NetworkSettings: &docker.NetworkSettings{Networks: map[string]docker.ContainerNetwork{
+		"backend": {IPAddress: "10.0.0.2", GlobalIPv6Address: "FD00:0::2"},
+	}}})
+	for _, ip := range []string{"10.0.0.2", "::ffff:10.0.0.2", "fd00::2", "fd00:0:0:0::2"} {
+		if m, ok, err := cache.lookupIP(ip, Caller{}); err != nil || !ok || m.Container.ID != "web" || m.Network != "backend" {
+			t.Fatalf("Unexpected match for %s: %+v %t (%v)", ip, m, ok, err)
+		}
+	}
+}
@@ -2,42 +2,174 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/agrarianlabs/localdiscovery"
-	"github.com/creack/ehttp"
 )
 
 var (
-	defaultPort      = 9090
-	defaultDockerURL = "unix:///var/run/docker.sock"
+	defaultPort          = 9090
+	defaultDockerURL     = "unix:///var/run/docker.sock"
+	defaultDiscoveryPath = "/var/lib/localdiscovery"
 )
 
+// discoveryPath returns the discovery directory of the given environment,
+// shared by the registrator and the DNS responder.
+func discoveryPath(getenv func(string) string) string {
+	if pth := getenv("DISCOVERY_PATH"); pth != "" {
+		return pth
+	}
+	return defaultDiscoveryPath
+}
+
+// runRegistrator writes the discovery files of the labeled containers until interrupted.
+func runRegistrator(discovery *localdiscovery.DockerDiscovery) {
+	dir := discoveryPath(os.Getenv)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logrus.Fatal(err)
+	}
+
+	stopChan := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		close(stopChan)
+	}()
+
+	logrus.Printf("registering services in %s", dir)
+	registrator := localdiscovery.NewRegistrator(discovery, dir)
+	registrator.ExcludeUnhealthy = os.Getenv("EXCLUDE_UNHEALTHY") != ""
+	registrator.Run(stopChan)
+	_ = discovery.Close() // Best effort.
+}
+
+// newDockerDiscovery connects to the docker endpoints of the given environment.
+func newDockerDiscovery(getenv func(string) string) (*localdiscovery.DockerDiscovery, error) {
+	dockerURL := getenv("DOCKER_URL")
+	if dockerURL == "" {
+		dockerURL = defaultDockerURL
+	}
+	endpoints := []localdiscovery.DockerEndpoint{{URL: dockerURL, CertPath: getenv("DOCKER_CERT_PATH")}}
+	// Comma separated list of name=url[;certpath] serving several docker daemons, overrides DOCKER_URL.
+	if list := getenv("DOCKER_ENDPOINTS"); list != "" {
+		var err error
+		if endpoints, err = localdiscovery.ParseDockerEndpoints(list); err != nil {
+			return nil, err
+		}
+	}
+	return localdiscovery.NewDockerDiscoveryEndpoints(endpoints...)
+}
+
+// newStaticBackend loads the STATIC_FILE mapping file of the given environment.
+func newStaticBackend(getenv func(string) string) (*localdiscovery.StaticBackend, error) {
+	path := getenv("STATIC_FILE")
+	if path == "" {
+		return nil, fmt.Errorf("STATIC_FILE is required by the static backend")
+	}
+	return localdiscovery.NewStaticBackend(path)
+}
+
+// reloadOnHangup reloads the mapping file of the static backend upon SIGHUP.
+func reloadOnHangup(backend *localdiscovery.StaticBackend) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		for range sigChan {
+			if err := backend.Reload(); err != nil {
+				logrus.WithError(err).Error("error reloading the mapping file")
+				continue
+			}
+			logrus.Print("reloaded the mapping file")
+		}
+	}()
+}
+
+// newHandler returns the API handler of the given backend served on the given listener,
+// both wrapped according to the trusted proxies of the given environment.
+func newHandler(backend localdiscovery.Backend, listener net.Listener, getenv func(string) string) (http.Handler, net.Listener, error) {
+	var handler http.Handler = localdiscovery.NewRouter(backend)
+	// Comma separated list of CIDRs allowed to forward the client address.
+	if list := getenv("TRUSTED_PROXIES"); list != "" {
+		proxies, err := localdiscovery.ParseTrustedProxies(list)
+		if err != nil {
+			return nil, nil, err
+		}
+		handler = proxies.Handler(handler)
+		if getenv("PROXY_PROTOCOL") != "" {
+			listener = localdiscovery.NewProxyProtoListener(listener, proxies)
+		}
+	}
+	return handler, listener, nil
+}
+
 // TODO: move this back to private repo with service controller.
 func main() {
-	var (
-		listenAddr string
-		dockerURL  string
-	)
-
+	var listenAddr string
 	if port := os.Getenv("PORT"); port == "" {
 		listenAddr = fmt.Sprintf(":%d", defaultPort)
 	} else {
 		listenAddr = ":" + port
 	}
-	if url := os.Getenv("DOCKER_URL"); url == "" {
-		dockerURL = defaultDockerURL
-	} else {
-		dockerURL = url
+
+	var trustPolicy localdiscovery.TrustPolicy
+	if policy := os.Getenv("TRUST_POLICY"); policy != "" {
+		var err error
+		if trustPolicy, err = localdiscovery.ParseTrustPolicy(policy); err != nil {
+			logrus.Fatal(err)
+		}
 	}
 
-	logrus.Printf("ready on %s", listenAddr)
+	// BACKEND selects the container source: docker (default) or static.
+	var backend localdiscovery.Backend
+	switch name := os.Getenv("BACKEND"); name {
+	case "", "docker":
+		discovery, err := newDockerDiscovery(os.Getenv)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		// `discover registrator` populates the discovery directory instead of serving the lookups.
+		if len(os.Args) > 1 && os.Args[1] == "registrator" {
+			runRegistrator(discovery)
+			return
+		}
+		discovery.TrustPolicy = trustPolicy
+		// Optional DNS responder, ex: DNS_ADDR=:5353.
+		if dnsAddr := os.Getenv("DNS_ADDR"); dnsAddr != "" {
+			dnsServer := localdiscovery.NewDNSServer(discovery, discoveryPath(os.Getenv))
+			if domain := os.Getenv("DNS_DOMAIN"); domain != "" {
+				dnsServer.Domain = domain
+			}
+			dnsServer.ExcludeUnhealthy = os.Getenv("EXCLUDE_UNHEALTHY") != ""
+			go func() { logrus.Fatal(dnsServer.ListenAndServe(dnsAddr)) }()
+			logrus.Printf("DNS ready on %s", dnsAddr)
+		}
+		backend = discovery
+	case "static":
+		static, err := newStaticBackend(os.Getenv)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		reloadOnHangup(static)
+		static.TrustPolicy = trustPolicy
+		backend = static
+	default:
+		logrus.Fatalf("unknown backend %q", name)
+	}
 
-	discovery, err := localdiscovery.NewDockerDiscovery(dockerURL)
+	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		logrus.Fatal(err)
 	}
-	logrus.Fatal(http.ListenAndServe(listenAddr, ehttp.HandlerFunc(discovery.LookupHandler)))
+	handler, listener, err := newHandler(backend, listener, os.Getenv)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Printf("ready on %s", listenAddr)
+	logrus.Fatal(http.Serve(listener, handler))
 }
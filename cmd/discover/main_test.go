@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	docker "github.com/fsouza/go-dockerclient"
+	dockertest "github.com/fsouza/go-dockerclient/testing"
+)
+
+// env returns a getenv function serving the given variables.
+func env(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+// newFakeDocker starts a fake docker server running a container publishing 80/tcp on 8080.
+func newFakeDocker(t *testing.T) (*dockertest.DockerServer, *docker.Container, func()) {
+	server, err := dockertest.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := server.Stop
+
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	if err := client.PullImage(docker.PullImageOptions{Repository: "busybox"}, docker.AuthConfiguration{}); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	cont, err := client.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"}})
+	if err == nil {
+		err = client.StartContainer(cont.ID, &docker.HostConfig{PortBindings: map[docker.Port][]docker.PortBinding{"80/tcp": {{HostPort: "8080"}}}})
+	}
+	if err == nil {
+		cont, err = client.InspectContainer(cont.ID)
+	}
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return server, cont, stop
+}
+
+func TestNewDockerDiscovery(t *testing.T) {
+	server, _, stop := newFakeDocker(t)
+	defer stop()
+
+	for _, tc := range []struct {
+		vars map[string]string
+		fail bool
+	}{
+		{vars: map[string]string{"DOCKER_URL": server.URL()}},
+		{vars: map[string]string{"DOCKER_URL": "nope", "DOCKER_ENDPOINTS": "a=" + server.URL() + ",b=" + server.URL()}},
+		{vars: map[string]string{"DOCKER_URL": server.URL(), "DOCKER_ENDPOINTS": server.URL()}, fail: true},
+		{vars: map[string]string{"DOCKER_URL": "tcp://127.0.0.1:1"}, fail: true},
+	} {
+		discovery, err := newDockerDiscovery(env(tc.vars))
+		if tc.fail {
+			if err == nil {
+				_ = discovery.Close()
+				t.Fatalf("Expected error for %v", tc.vars)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", tc.vars, err)
+		}
+		_ = discovery.Close()
+	}
+
+	if _, err := newStaticBackend(env(nil)); err == nil {
+		t.Fatal("Expected error without STATIC_FILE")
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	server, cont, stop := newFakeDocker(t)
+	defer stop()
+	discovery, err := newDockerDiscovery(env(map[string]string{"DOCKER_URL": server.URL()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+
+	if _, _, err := newHandler(discovery, nil, env(map[string]string{"TRUSTED_PROXIES": "nope"})); err == nil {
+		t.Fatal("Expected error for invalid trusted proxies")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, listener, err := newHandler(discovery, l, env(map[string]string{"TRUSTED_PROXIES": "127.0.0.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() { _ = http.Serve(listener, handler) }()
+
+	// The lookup is forwarded by the local host on behalf of the container.
+	req, err := http.NewRequest("GET", "http://"+listener.Addr().String()+"/v1/self/ports/80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", cont.NetworkSettings.IPAddress)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+	}
+	var lookup discoverclient.LookupResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lookup); err != nil {
+		t.Fatal(err)
+	}
+	if lookup.Container != cont.ID || len(lookup.Bindings) != 1 || lookup.Bindings[0].HostPort != 8080 {
+		t.Fatalf("Unexpected lookup response: %+v", lookup)
+	}
+}
+
+func TestDiscoveryPath(t *testing.T) {
+	if pth := discoveryPath(env(nil)); pth != defaultDiscoveryPath {
+		t.Fatalf("Unexpected default discovery path: %s", pth)
+	}
+	if pth := discoveryPath(env(map[string]string{"DISCOVERY_PATH": "/tmp/discovery"})); pth != "/tmp/discovery" {
+		t.Fatalf("Unexpected discovery path: %s", pth)
+	}
+}
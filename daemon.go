@@ -0,0 +1,197 @@
+package localdiscovery
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DockerEndpoint is a docker daemon served by the discovery.
+type DockerEndpoint struct {
+	// Name tags the containers of the daemon in the lookup results. ex: system, user-1000.
+	// May be empty when there is a single endpoint.
+	Name string
+	// URL is the docker daemon address. ex: unix:///var/run/docker.sock, tcp://10.0.0.2:2376.
+	URL string
+	// CertPath is the optional directory of the TLS cert.pem, key.pem and ca.pem files.
+	// TLS is enabled when set, like docker's DOCKER_CERT_PATH.
+	CertPath string
+}
+
+// String returns the endpoint name, or its URL when unnamed.
+func (e DockerEndpoint) String() string {
+	if e.Name == "" {
+		return e.URL
+	}
+	return e.Name
+}
+
+// ParseDockerEndpoints parses a comma separated list of docker endpoints.
+// Each endpoint is name=url with an optional ;certpath suffix enabling TLS.
+// ex: system=unix:///var/run/docker.sock,remote=tcp://10.0.0.2:2376;/etc/docker/remote
+func ParseDockerEndpoints(list string) ([]DockerEndpoint, error) {
+	var endpoints []DockerEndpoint
+	for _, elem := range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		parts := strings.SplitN(elem, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid docker endpoint %q, expected name=url", elem)
+		}
+		endpoint := DockerEndpoint{Name: parts[0], URL: parts[1]}
+		if i := strings.Index(endpoint.URL, ";"); i != -1 {
+			endpoint.URL, endpoint.CertPath = endpoint.URL[:i], endpoint.URL[i+1:]
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no docker endpoint in %q", list)
+	}
+	return endpoints, nil
+}
+
+// validateEndpoints checks the endpoint names are unique
+// and only the single endpoint is allowed to be unnamed.
+func validateEndpoints(endpoints []DockerEndpoint) error {
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no docker endpoint")
+	}
+	names := map[string]struct{}{}
+	for _, endpoint := range endpoints {
+		if endpoint.Name == "" && len(endpoints) > 1 {
+			return fmt.Errorf("unnamed docker endpoint %s", endpoint.URL)
+		}
+		if _, ok := names[endpoint.Name]; ok {
+			return fmt.Errorf("duplicate docker endpoint %q", endpoint.Name)
+		}
+		names[endpoint.Name] = struct{}{}
+	}
+	return nil
+}
+
+// newDockerClient instantiates the docker client of the given endpoint.
+func newDockerClient(endpoint DockerEndpoint) (*docker.Client, error) {
+	if endpoint.CertPath == "" {
+		return docker.NewClient(endpoint.URL)
+	}
+	return docker.NewTLSClient(
+		endpoint.URL,
+		filepath.Join(endpoint.CertPath, "cert.pem"),
+		filepath.Join(endpoint.CertPath, "key.pem"),
+		filepath.Join(endpoint.CertPath, "ca.pem"),
+	)
+}
+
+// DockerClient is the subset of the docker API used by the discovery.
+// Implemented by *docker.Client, see NewDockerDiscoveryWithClient.
+// The event listeners are not used with a *docker.Client, its event stream is read directly.
+type DockerClient interface {
+	Ping() error
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	InspectContainer(id string) (*docker.Container, error)
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+	ListTasks(opts docker.ListTasksOptions) ([]swarm.Task, error)
+	InspectService(id string) (*swarm.Service, error)
+}
+
+// dockerDaemon keeps the cache in sync with the containers of a docker endpoint.
+type dockerDaemon struct {
+	name    string
+	client  DockerClient
+	cache   *containerCache // Shared by the daemons.
+	metrics *metrics
+
+	swarmManager int32 // Set when the task list is available, accessed atomically.
+
+	refreshLock sync.Mutex // Serializes the reconciliations.
+
+	syncLock sync.Mutex
+	syncErr  error // Error of the last reconciliation, nil once reconciled.
+}
+
+// dockerCall records a docker API call of the daemon.
+func (d *dockerDaemon) dockerCall(call string, start time.Time, err error) {
+	d.metrics.dockerCall(d.name, call, start, err)
+}
+
+// log returns the logger of the daemon.
+func (d *dockerDaemon) log() *logrus.Entry {
+	return logrus.WithField("endpoint", d.name)
+}
+
+// reconcile lists and inspects all the running containers and replaces the daemon cache content.
+func (d *dockerDaemon) reconcile() error {
+	d.refreshLock.Lock()
+	defer d.refreshLock.Unlock()
+	return d.reconcileLocked()
+}
+
+// reconcileLocked reconciles the daemon cache. Expects refreshLock to be held.
+func (d *dockerDaemon) reconcileLocked() error {
+	start := time.Now()
+	containers, err := d.client.ListContainers(docker.ListContainersOptions{All: false})
+	d.dockerCall("list_containers", start, err)
+	d.syncLock.Lock()
+	d.syncErr = err
+	d.syncLock.Unlock()
+	if err != nil {
+		return err
+	}
+	conts := make([]*docker.Container, 0, len(containers))
+	for _, apiCont := range containers {
+		// Fetch more details about that container.
+		start := time.Now()
+		cont, err := d.client.InspectContainer(apiCont.ID)
+		d.dockerCall("inspect_container", start, err)
+		if err != nil {
+			d.log().WithError(err).WithField("container", apiCont.ID).Error("error inspecting container, skipping")
+			continue
+		}
+		conts = append(conts, cont)
+	}
+	d.cache.replaceTasks(d.name, conts, d.taskServices(conts, true))
+	return nil
+}
+
+// syncError returns the error of the last reconciliation, nil once reconciled.
+func (d *dockerDaemon) syncError() error {
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
+	return d.syncErr
+}
+
+// refresh reconciles the daemon cache unless it has been done recently.
+// Used upon cache miss to catch up with containers which events are not yet processed.
+func (d *dockerDaemon) refresh() error {
+	if time.Since(d.cache.lastEndpointUpdate(d.name)) < refreshMinInterval {
+		return nil
+	}
+	d.refreshLock.Lock()
+	defer d.refreshLock.Unlock()
+	// The concurrent misses wait for the reconciliation in progress instead of running their own.
+	if time.Since(d.cache.lastEndpointUpdate(d.name)) < refreshMinInterval {
+		return nil
+	}
+	if err := d.reconcileLocked(); err != nil {
+		d.log().WithError(err).Error("error reconciling the container cache")
+		return err
+	}
+	return nil
+}
+
+// ping checks the daemon connectivity.
+func (d *dockerDaemon) ping() error {
+	start := time.Now()
+	err := d.client.Ping()
+	d.dockerCall("ping", start, err)
+	return err
+}
@@ -0,0 +1,338 @@
+package localdiscovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	docker "github.com/fsouza/go-dockerclient"
+	dockertest "github.com/fsouza/go-dockerclient/testing"
+)
+
+func TestParseDockerEndpoints(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		expect []DockerEndpoint
+		fail   bool
+	}{
+		{in: "system=unix:///var/run/docker.sock", expect: []DockerEndpoint{{Name: "system", URL: "unix:///var/run/docker.sock"}}},
+		{in: "a=tcp://10.0.0.1:2375, b=tcp://10.0.0.2:2376;/etc/docker/b", expect: []DockerEndpoint{
+			{Name: "a", URL: "tcp://10.0.0.1:2375"},
+			{Name: "b", URL: "tcp://10.0.0.2:2376", CertPath: "/etc/docker/b"},
+		}},
+		{in: "unix:///var/run/docker.sock", fail: true},
+		{in: "a=", fail: true},
+		{in: " , ", fail: true},
+	} {
+		endpoints, err := ParseDockerEndpoints(tc.in)
+		if tc.fail {
+			if err == nil {
+				t.Fatalf("Expected error for %q, got %v", tc.in, endpoints)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", tc.in, err)
+		}
+		if !reflect.DeepEqual(endpoints, tc.expect) {
+			t.Fatalf("Unexpected endpoints for %q.\nExpected: %v\nGot:      %v", tc.in, tc.expect, endpoints)
+		}
+	}
+
+	for _, endpoints := range [][]DockerEndpoint{
+		nil,
+		{{Name: "a", URL: "unix:///a"}, {Name: "a", URL: "unix:///b"}},
+		{{URL: "unix:///a"}, {Name: "b", URL: "unix:///b"}},
+	} {
+		if err := validateEndpoints(endpoints); err == nil {
+			t.Fatalf("Expected error for %v", endpoints)
+		}
+	}
+}
+
+// newFakeDocker starts a fake docker server streaming random events. Call stop to release it.
+func newFakeDocker(t *testing.T) (server *dockertest.DockerServer, stop func()) {
+	server, err := dockertest.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, server.Stop
+}
+
+// startTestContainer runs a container publishing the given port on the given host port.
+func startTestContainer(t *testing.T, server *dockertest.DockerServer, port docker.Port, hostPort string) *docker.Container {
+	return runTestContainer(t, server, map[docker.Port][]docker.PortBinding{port: {{HostPort: hostPort}}})
+}
+
+// runTestContainer runs a container exposing the given ports on the given host bindings.
+// A port without binding is exposed but not published.
+func runTestContainer(t *testing.T, server *dockertest.DockerServer, bindings map[docker.Port][]docker.PortBinding) *docker.Container {
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PullImage(docker.PullImageOptions{Repository: "busybox"}, docker.AuthConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	exposed := make(map[docker.Port]struct{}, len(bindings))
+	for port := range bindings {
+		exposed[port] = struct{}{}
+	}
+	cont, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: "busybox", ExposedPorts: exposed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StartContainer(cont.ID, &docker.HostConfig{PortBindings: bindings}); err != nil {
+		t.Fatal(err)
+	}
+	if cont, err = client.InspectContainer(cont.ID); err != nil {
+		t.Fatal(err)
+	}
+	return cont
+}
+
+func TestDockerDiscoveryEndpoints(t *testing.T) {
+	system, stopSystem := newFakeDocker(t)
+	defer stopSystem()
+	user, stopUser := newFakeDocker(t)
+	defer stopUser()
+	systemCont := startTestContainer(t, system, "80/tcp", "8001")
+	userCont := startTestContainer(t, user, "80/tcp", "8002")
+
+	discovery, err := NewDockerDiscoveryEndpoints(
+		DockerEndpoint{Name: "system", URL: system.URL()},
+		DockerEndpoint{Name: "user", URL: user.URL()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+	// The fake servers pick the container IPs randomly, they may collide.
+	discovery.TrustPolicy = TrustHints
+
+	for _, tc := range []struct {
+		cont     *docker.Container
+		endpoint string
+		hostPort int
+	}{
+		{cont: systemCont, endpoint: "system", hostPort: 8001},
+		{cont: userCont, endpoint: "user", hostPort: 8002},
+	} {
+		resp, err := discovery.LookupPort(Caller{Hostname: tc.cont.Config.Hostname}, "80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Container != tc.cont.ID || resp.Endpoint != tc.endpoint || len(resp.Bindings) != 1 || resp.Bindings[0].HostPort != tc.hostPort {
+			t.Fatalf("Unexpected response for %s: %+v", tc.endpoint, resp)
+		}
+	}
+	infos, err := discovery.ListContainers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := map[string]string{}
+	for _, info := range infos {
+		endpoints[info.ID] = info.Endpoint
+		if len(info.Ports) != 1 || info.Ports[0].Endpoint != info.Endpoint {
+			t.Fatalf("Unexpected ports for %s: %+v", info.ID, info.Ports)
+		}
+	}
+	if expect := map[string]string{systemCont.ID: "system", userCont.ID: "user"}; !reflect.DeepEqual(endpoints, expect) {
+		t.Fatalf("Unexpected container endpoints.\nExpected: %v\nGot:      %v", expect, endpoints)
+	}
+
+	health := func(expectCode int) discoverclient.HealthResponse {
+		w := httptest.NewRecorder()
+		discovery.Router().ServeHTTP(w, httptest.NewRequest("GET", healthPath, nil))
+		if w.Code != expectCode {
+			t.Fatalf("Unexpected health status code.\nExpected: %d\nGot:      %d (%s)", expectCode, w.Code, w.Body)
+		}
+		var resp discoverclient.HealthResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := health(http.StatusOK); resp.Status != discoverclient.StatusOK || len(resp.Endpoints) != 2 {
+		t.Fatalf("Unexpected health: %+v", resp)
+	}
+	user.Stop() // Refuses the new connections, the event stream is kept.
+	if resp := health(http.StatusOK); resp.Status != discoverclient.StatusDegraded || resp.Endpoints["system"] != discoverclient.StatusOK || resp.Endpoints["user"] == discoverclient.StatusOK {
+		t.Fatalf("Unexpected health with an unreachable endpoint: %+v", resp)
+	}
+	system.Stop()
+	health(http.StatusServiceUnavailable)
+}
+
+func TestDockerDiscoveryDegradedStartup(t *testing.T) {
+	defer func(delay time.Duration) { eventRetryDelay = delay }(eventRetryDelay)
+	eventRetryDelay = 10 * time.Millisecond
+
+	system := newFakeClient(fakeContainer("a", "172.17.0.2"))
+	user := newFakeClient(fakeContainer("b", "172.17.0.3"))
+	user.listErr = errors.New("user daemon down")
+	discovery, err := newDockerDiscovery([]string{"system", "user"}, []DockerClient{system, user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+
+	resp, err := discovery.Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != discoverclient.StatusDegraded || resp.Endpoints["system"] != discoverclient.StatusOK || resp.Endpoints["user"] != "user daemon down" {
+		t.Fatalf("Unexpected health: %+v", resp)
+	}
+	if m, err := discovery.LookupContainer(Caller{RemoteIP: "172.17.0.2"}); err != nil || m.Container.ID != "a" {
+		t.Fatalf("Unexpected match: %+v (%v)", m, err)
+	}
+
+	// The failed daemon is retried.
+	user.mu.Lock()
+	user.listErr = nil
+	user.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if resp, err := discovery.Health(); err == nil && resp.Status == discoverclient.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the user daemon")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := discovery.cache.get("b"); !ok {
+		t.Fatal("Container b not found in cache")
+	}
+
+	// Fails when all the daemons are down.
+	for _, client := range []*fakeClient{system, user} {
+		client.mu.Lock()
+		client.listErr = errors.New("daemon down")
+		client.mu.Unlock()
+	}
+	if _, err := newDockerDiscovery([]string{"system", "user"}, []DockerClient{system, user}); err == nil {
+		t.Fatal("Expected error when all the daemons are down")
+	}
+}
+
+// listCounter wraps a docker client to count the container listings.
+type listCounter struct {
+	DockerClient
+
+	lists int64 // Accessed atomically.
+}
+
+// ListContainers implements DockerClient.
+func (c *listCounter) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	atomic.AddInt64(&c.lists, 1)
+	return c.DockerClient.ListContainers(opts)
+}
+
+func TestDockerDiscoveryOverlappingIPs(t *testing.T) {
+	// Rootless daemons all use the default bridge subnet.
+	var (
+		names   = []string{"alice", "bob"}
+		conts   []*docker.Container
+		clients []DockerClient
+		counts  []*listCounter
+	)
+	for i := range names {
+		server, stop := newFakeDocker(t)
+		defer stop()
+		conts = append(conts, startTestContainer(t, server, "80/tcp", fmt.Sprintf("800%d", i)))
+		dockerClient, err := docker.NewClient(server.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Docker derives the default MAC address from the IP.
+		count := &listCounter{DockerClient: &hookClient{DockerClient: dockerClient, inspect: func(cont *docker.Container) {
+			cont.NetworkSettings.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.2", MacAddress: "02:42:ac:11:00:02"}}
+		}}}
+		counts = append(counts, count)
+		clients = append(clients, count)
+	}
+	discovery, err := newDockerDiscovery(names, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+
+	for _, tc := range []struct {
+		caller Caller
+		policy TrustPolicy
+		expect int // Index of the expected container, -1 when ambiguous.
+	}{
+		{caller: Caller{RemoteIP: "172.17.0.2"}, expect: -1},
+		{caller: Caller{RemoteIP: "172.17.0.2", Hostname: conts[1].Config.Hostname}, expect: 1},
+		{caller: Caller{RemoteIP: "172.17.0.2", MAC: "02:42:AC:11:00:02"}, expect: -1},
+		{caller: Caller{RemoteIP: "172.17.0.2", MAC: "02:42:ac:11:00:02", Hostname: conts[0].Config.Hostname}, expect: 0},
+		{caller: Caller{RemoteIP: "172.17.0.2", MAC: "02:42:ac:11:00:03", Hostname: conts[1].Config.Hostname}, expect: -1},
+		{caller: Caller{RemoteIP: "172.17.0.2", Hostname: "nope"}, expect: -1},
+		// The trusted MAC hint matches both containers as well.
+		{caller: Caller{MAC: "02:42:ac:11:00:02"}, policy: TrustHints, expect: -1},
+		{caller: Caller{MAC: "02:42:ac:11:00:02", Hostname: conts[1].Config.Hostname}, policy: TrustHints, expect: -1},
+	} {
+		discovery.TrustPolicy = tc.policy
+		m, err := discovery.LookupContainer(tc.caller)
+		if tc.expect == -1 {
+			expectAPIError(t, err, discoverclient.CodeAmbiguousCaller)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", tc.caller, err)
+		}
+		if m.Container.ID != conts[tc.expect].ID {
+			t.Fatalf("Unexpected match for %s.\nExpected: %s\nGot:      %s", tc.caller, conts[tc.expect].ID, m.Container.ID)
+		}
+	}
+	discovery.TrustPolicy = TrustRemote
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", selfPortsPath+"80", nil)
+	req.RemoteAddr = "172.17.0.2:1234"
+	discovery.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Unexpected status code for an ambiguous caller: %d (%s)", w.Code, w.Body)
+	}
+
+	// The concurrent cache misses share a single reconciliation per daemon.
+	time.Sleep(refreshMinInterval)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = discovery.LookupContainer(Caller{RemoteIP: "10.0.0.9"})
+		}()
+	}
+	wg.Wait()
+	expectLists := func(expect int64) {
+		for i, count := range counts {
+			if lists := atomic.LoadInt64(&count.lists); lists != expect {
+				t.Fatalf("Unexpected list count for %s.\nExpected: %d\nGot:      %d", names[i], expect, lists)
+			}
+		}
+	}
+	expectLists(2)
+
+	// The misses of the same caller IP are not refreshed again for a while.
+	time.Sleep(refreshMinInterval)
+	_, err = discovery.LookupContainer(Caller{RemoteIP: "10.0.0.9"})
+	expectAPIError(t, err, discoverclient.CodeContainerNotFound)
+	expectLists(2)
+	_, err = discovery.LookupContainer(Caller{RemoteIP: "10.0.0.10"})
+	expectAPIError(t, err, discoverclient.CodeContainerNotFound)
+	expectLists(3)
+}
@@ -0,0 +1,209 @@
+package discoverclient
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client defaults.
+const (
+	DefaultTimeout    = 10 * time.Second
+	DefaultMaxRetries = 3
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+// Client is a client for the discover service API.
+// Requests failing with a connection error or a 5xx status are retried
+// with a jittered exponential backoff.
+type Client struct {
+	HTTPClient *http.Client // Client used for the requests.
+	BaseURL    string       // Address of the discover service. ex: http://172.17.0.1:9090
+	MaxRetries int          // Maximum number of retries. 0 disables the retries.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RequireHealth is the health requirement of the port lookups. Defaults to HealthIgnore.
+	// With HealthWait, the lookups wait until the container is healthy or the context is done.
+	RequireHealth HealthRequirement
+}
+
+// NewClient instantiates a new Client with the default settings.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		BaseURL:    baseURL,
+		MaxRetries: DefaultMaxRetries,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// LookupPort looks up the publicly exposed port for the current host.
+// Returns the first host port.
+// Returns ErrNotPublished if the port is exposed but not published.
+// See LookupBindings for the other errors.
+func (c *Client) LookupPort(ctx context.Context, iface, port string) (int, error) {
+	resp, err := c.LookupBindings(ctx, iface, port)
+	if err != nil {
+		return -1, err
+	}
+	if len(resp.Bindings) == 0 {
+		return -1, ErrNotPublished
+	}
+	return resp.Bindings[0].HostPort, nil
+}
+
+// LookupBindings looks up all the host bindings of the given port for the current host.
+// - iface is the network interface to lookup. Its IP and MAC are sent as identity hints, if readable.
+// - port is a string and may contain /udp or /tcp suffix.
+// Returns ErrContainerNotFound, ErrNotExposed, ErrBackendUnavailable, ErrContainerUnhealthy,
+// ErrAmbiguousCaller or ErrBadRequest when the discover service reports so.
+func (c *Client) LookupBindings(ctx context.Context, iface, port string) (*LookupResponse, error) {
+	query := hostQuery(iface)
+	if c.RequireHealth != HealthIgnore {
+		query.Set("health", string(c.RequireHealth))
+	}
+	for attempt := 0; ; attempt++ {
+		var resp LookupResponse
+		err := c.get(ctx, "/v1/self/ports/"+port, query, &resp)
+		if err == nil {
+			return &resp, nil
+		}
+		if attempt > 0 && ctx.Err() != nil {
+			// The context is done while waiting for the container to be healthy.
+			return nil, ErrContainerUnhealthy
+		}
+		// The service waits for a while before failing, keep waiting until the context is done.
+		if err != ErrContainerUnhealthy || c.RequireHealth != HealthWait {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(c.backoff(attempt)):
+		}
+	}
+}
+
+// Self returns the details of the current host container.
+// - iface is the network interface to lookup. Its IP and MAC are sent as identity hints, if readable.
+func (c *Client) Self(ctx context.Context, iface string) (*ContainerInfo, error) {
+	query := hostQuery(iface)
+	var info ContainerInfo
+	if err := c.get(ctx, "/v1/self", query, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Containers lists the containers known by the discover service.
+func (c *Client) Containers(ctx context.Context) ([]ContainerInfo, error) {
+	var infos []ContainerInfo
+	if err := c.get(ctx, "/v1/containers", nil, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// Health checks the discover service health.
+// Returns ErrBackendUnavailable when the discover service can't reach its backend.
+// See EndpointsHealth for the health of each docker endpoint.
+func (c *Client) Health(ctx context.Context) error {
+	_, err := c.EndpointsHealth(ctx)
+	return err
+}
+
+// EndpointsHealth returns the discover service health along with the health of each docker endpoint.
+// Returns ErrBackendUnavailable when the discover service can't reach any of its docker endpoints.
+func (c *Client) EndpointsHealth(ctx context.Context) (*HealthResponse, error) {
+	var resp HealthResponse
+	if err := c.get(ctx, "/v1/health", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// hostQuery returns the identity hints of the current host as query parameters.
+func hostQuery(iface string) url.Values {
+	info := hostInfo(iface)
+	query := url.Values{}
+	for key, value := range map[string]string{"hostname": info.Hostname, "ip": info.IP, "mac": info.MAC} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	return query
+}
+
+// get sends a GET request. See do.
+func (c *Client) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return c.do(ctx, "GET", path, query, out)
+}
+
+// do sends the request and decodes the json response in out.
+// Retries on connection errors and 5xx responses until MaxRetries is reached or the context is done.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, out interface{}) error {
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		if retry, err = c.try(ctx, httpClient, method, u, out); !retry || attempt >= c.MaxRetries {
+			return err
+		}
+		timer := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// try sends the request once. Returns whether or not the request can be retried.
+func (c *Client) try(ctx context.Context, httpClient *http.Client, method, u string, out interface{}) (bool, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		// Don't retry if the error comes from the context.
+		return ctx.Err() == nil, err
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close() // best effort.
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500, responseError(resp.StatusCode, buf)
+	}
+	return false, json.Unmarshal(buf, out)
+}
+
+// backoff returns a random delay between 0 and MinBackoff * 2^attempt, capped at MaxBackoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	max := c.MinBackoff << uint(attempt)
+	if max <= 0 || max > c.MaxBackoff {
+		max = c.MaxBackoff
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,139 @@
+package discoverclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSelfDockerLookup(t *testing.T) {
+	// The legacy lookup is POSTed to the given URL as is.
+	requests := make(chan LookupRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/lookup" {
+			http.NotFound(w, req)
+			return
+		}
+		var lookupReq LookupRequest
+		if err := json.NewDecoder(req.Body).Decode(&lookupReq); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests <- lookupReq
+		switch lookupReq.Port {
+		case "80":
+			_ = json.NewEncoder(w).Encode(8080)
+		case "81":
+			_ = json.NewEncoder(w).Encode(0)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(ErrorResponse{Error: &APIError{Code: CodeContainerNotFound, Message: "not found"}})
+		}
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		port   string
+		expect int
+		err    error
+	}{
+		{port: "80", expect: 8080},
+		{port: "81", expect: 0},
+		{port: "82", expect: -1, err: ErrContainerNotFound},
+	} {
+		port, err := SelfDockerLookup(server.URL+"/lookup", "nope0", tc.port)
+		if err != tc.err {
+			t.Fatalf("Unexpected error for %s.\nExpected: %v\nGot:      %v", tc.port, tc.err, err)
+		}
+		if port != tc.expect {
+			t.Fatalf("Unexpected port for %s.\nExpected: %d\nGot:      %d", tc.port, tc.expect, port)
+		}
+		// Only the hostname hint is sent when the interface is missing.
+		lookupReq := <-requests
+		hostname, _ := os.Hostname()
+		if lookupReq.Port != tc.port || lookupReq.Hostname != hostname || lookupReq.IP != "" || lookupReq.MAC != "" {
+			t.Fatalf("Unexpected lookup request: %+v", lookupReq)
+		}
+	}
+}
+
+func TestLookupBindingsMissingInterface(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/self/ports/80" {
+			http.NotFound(w, req)
+			return
+		}
+		queries <- req.URL.Query()
+		_ = json.NewEncoder(w).Encode(LookupResponse{Port: "80/tcp", State: PortPublished, Bindings: []PortBinding{{HostPort: 8080}}})
+	}))
+	defer server.Close()
+
+	port, err := NewClient(server.URL).LookupPort(context.Background(), "nope0", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 8080 {
+		t.Fatalf("Unexpected port.\nExpected: %d\nGot:      %d", 8080, port)
+	}
+	// Only the hostname hint is sent.
+	query := <-queries
+	hostname, _ := os.Hostname()
+	if query.Get("hostname") != hostname || query.Get("ip") != "" || query.Get("mac") != "" {
+		t.Fatalf("Unexpected identity hints: %v", query)
+	}
+}
+
+func TestLookupBindingsHealthWait(t *testing.T) {
+	var healthyAfter int32 // Number of unhealthy responses before the healthy one, -1 for never.
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if health := req.URL.Query().Get("health"); health != string(HealthWait) {
+			http.Error(w, "unexpected health requirement "+health, http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt32(&requests, 1)
+		if after := atomic.LoadInt32(&healthyAfter); after < 0 || n <= after {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(ErrorResponse{Error: &APIError{Code: CodeContainerUnhealthy, Message: "starting"}})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(LookupResponse{Port: "80/tcp", State: PortPublished, Health: HealthHealthy, Bindings: []PortBinding{{HostPort: 8080}}})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.RequireHealth = HealthWait
+	client.MinBackoff, client.MaxBackoff = time.Millisecond, 10*time.Millisecond
+
+	// Retries until healthy.
+	atomic.StoreInt32(&healthyAfter, 3)
+	resp, err := client.LookupBindings(context.Background(), "", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Health != HealthHealthy || len(resp.Bindings) != 1 || resp.Bindings[0].HostPort != 8080 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Fatalf("Unexpected request count.\nExpected: %d\nGot:      %d", 4, n)
+	}
+
+	// Gives up when the context is done.
+	atomic.StoreInt32(&healthyAfter, -1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.LookupBindings(ctx, "", "80"); err != ErrContainerUnhealthy {
+		t.Fatalf("Unexpected error.\nExpected: %v\nGot:      %v", ErrContainerUnhealthy, err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("Unexpected wait: %s", elapsed)
+	}
+}
@@ -2,24 +2,164 @@ package discoverclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// HealthStatus is the docker HEALTHCHECK status of a container.
+type HealthStatus string
+
+// Health statuses.
+const (
+	HealthNone      HealthStatus = ""          // The container has no healthcheck.
+	HealthStarting  HealthStatus = "starting"  // The first check did not pass yet.
+	HealthHealthy   HealthStatus = "healthy"   // The last check passed.
+	HealthUnhealthy HealthStatus = "unhealthy" // The checks are failing.
+)
+
+// PublishMode is how a swarm task port is published.
+type PublishMode string
+
+// Publish modes.
+const (
+	PublishIngress PublishMode = "ingress" // Published by the service on every swarm node via the routing mesh.
+	PublishHost    PublishMode = "host"    // Published by the task on the node it runs on.
+)
+
+// HealthRequirement is the behavior of a lookup while the container is not healthy.
+// Containers without healthcheck are always considered healthy.
+type HealthRequirement string
+
+// Health requirements.
+const (
+	HealthIgnore HealthRequirement = ""     // The health status is reported but not enforced.
+	HealthFail   HealthRequirement = "fail" // The lookup fails with ErrContainerUnhealthy.
+	HealthWait   HealthRequirement = "wait" // The lookup waits for the container to be healthy.
 )
 
 // LookupRequest is the data send via POST for the Lookup Handler.
+// Hostname, IP and MAC are identity hints for the discover service.
 type LookupRequest struct {
-	Port string
+	Port     string            `json:"port"`
+	Hostname string            `json:"hostname,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	MAC      string            `json:"mac,omitempty"`
+	Health   HealthRequirement `json:"health,omitempty"`
+}
+
+// hostInfo looks up the identity hints of the current host.
+// The IP and MAC are taken from the given network interface, if any.
+// They are only hints: when the interface can't be read, only the hostname is sent.
+func hostInfo(iface string) LookupRequest {
+	var req LookupRequest
+	if hostname, err := os.Hostname(); err == nil {
+		req.Hostname = hostname
+	}
+	if iface == "" {
+		return req
+	}
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		logrus.WithError(err).WithField("iface", iface).Debug("unable to read the network interface, sending the hostname only")
+		return req
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		logrus.WithError(err).WithField("iface", iface).Debug("unable to read the network interface addresses, sending the hostname only")
+		return req
+	}
+	req.MAC = netIface.HardwareAddr.String()
+	// Prefer IPv4, fallback on global IPv6.
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			req.IP = ipNet.IP.String()
+			break
+		}
+		if req.IP == "" {
+			req.IP = ipNet.IP.String()
+		}
+	}
+	return req
+}
+
+// PortState is the publication state of a container port.
+type PortState string
+
+// Port states.
+const (
+	PortPublished   PortState = "published"   // The port has at least one host binding.
+	PortUnpublished PortState = "unpublished" // The port is exposed but not published.
+)
+
+// PortBinding is a host binding of a container port.
+type PortBinding struct {
+	HostIP   string      `json:"host_ip"`
+	HostPort int         `json:"host_port"`
+	Protocol string      `json:"protocol"`
+	Mode     PublishMode `json:"mode,omitempty"` // Swarm publish mode, empty for the standalone containers.
+}
+
+// LookupResponse is the data returned by the Lookup Handler.
+type LookupResponse struct {
+	Port      string        `json:"port"`              // Container port. ex: 80/tcp.
+	Container string        `json:"container"`         // ID of the matched container.
+	Network   string        `json:"network,omitempty"` // Name of the network the caller matched on.
+	State     PortState     `json:"state"`
+	Bindings  []PortBinding `json:"bindings"`
+	Health    HealthStatus  `json:"health,omitempty"`   // Health status of the container, if it has a healthcheck.
+	Service   string        `json:"service,omitempty"`  // Name of the swarm service, if the container is a task.
+	Endpoint  string        `json:"endpoint,omitempty"` // Name of the docker endpoint running the container.
+}
+
+// ContainerInfo describes a running container and its ports.
+type ContainerInfo struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Hostname     string            `json:"hostname"`
+	Image        string            `json:"image"`
+	Network      string            `json:"network,omitempty"` // Name of the network the caller matched on.
+	Networks     map[string]string `json:"networks"`          // IPv4 keyed by network name.
+	IPv6Networks map[string]string `json:"ipv6_networks"`     // Global IPv6 keyed by network name.
+	Ports        []LookupResponse  `json:"ports"`
+	Health       HealthStatus      `json:"health,omitempty"`   // Health status, if the container has a healthcheck.
+	Service      string            `json:"service,omitempty"`  // Name of the swarm service, if the container is a task.
+	Endpoint     string            `json:"endpoint,omitempty"` // Name of the docker endpoint running the container.
+}
+
+// Service statuses of the HealthResponse.
+const (
+	StatusOK       = "ok"       // All the docker endpoints are reachable.
+	StatusDegraded = "degraded" // Some docker endpoints are unreachable, the others are served.
+)
+
+// HealthResponse is the data returned by the Health Handler.
+type HealthResponse struct {
+	Status    string            `json:"status"`
+	Endpoints map[string]string `json:"endpoints,omitempty"` // "ok" or the error of each docker endpoint, keyed by name.
 }
 
 // SelfDockerLookup looks up the publicly exposed port for the current host.
 // First lookup the local host infos, then sends the port lookup request.
-// - url is the address of the discover service.
-// - iface is the network interface to lookup.
+// - url is the address of the discover service lookup handler, the request is POSTed to it as is.
+// - iface is the network interface to lookup. Its IP and MAC are sent as identity hints, if readable.
 // - port is a string and may contain /udp or /tcp suffix.
+// Returns the first host port, 0 if the port is not exposed or not published.
+// Uses the legacy lookup API served by all the discover service versions, see Client for the v1 API.
 func SelfDockerLookup(url, iface, port string) (int, error) {
-	buf, err := json.Marshal(LookupRequest{Port: port})
+	lookupReq := hostInfo(iface)
+	lookupReq.Port = port
+	buf, err := json.Marshal(lookupReq)
 	if err != nil {
 		return -1, err
 	}
@@ -37,7 +177,7 @@ func SelfDockerLookup(url, iface, port string) (int, error) {
 		return -1, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return -1, fmt.Errorf("unexpected response: %d (%s)", resp.StatusCode, buf)
+		return -1, responseError(resp.StatusCode, buf)
 	}
 	var exposedPort int
 	if err := json.Unmarshal(buf, &exposedPort); err != nil {
@@ -45,3 +185,26 @@ func SelfDockerLookup(url, iface, port string) (int, error) {
 	}
 	return exposedPort, nil
 }
+
+// SelfDockerLookupBindings looks up all the host bindings of the given port for the current host.
+// First lookup the local host infos, then sends the port lookup request.
+// - url is the address of the discover service.
+// - iface is the network interface to lookup. Its IP and MAC are sent as identity hints, if readable.
+// - port is a string and may contain /udp or /tcp suffix.
+// Returns ErrContainerNotFound, ErrNotExposed, ErrBackendUnavailable or ErrBadRequest
+// when the discover service reports so.
+// Shorthand for NewClient(url).LookupBindings with a background context.
+func SelfDockerLookupBindings(url, iface, port string) (*LookupResponse, error) {
+	return NewClient(url).LookupBindings(context.Background(), iface, port)
+}
+
+// responseError converts the discover service error response to the matching sentinel error.
+func responseError(statusCode int, body []byte) error {
+	var errResp ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error != nil {
+		if err, ok := codeErrors[errResp.Error.Code]; ok {
+			return err
+		}
+	}
+	return fmt.Errorf("unexpected response: %d (%s)", statusCode, body)
+}
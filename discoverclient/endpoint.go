@@ -0,0 +1,187 @@
+package discoverclient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiscoveryFileVersion is the version of the JSON discovery file format.
+const DiscoveryFileVersion = 1
+
+// Endpoint is an instance of a service listed in a discovery file.
+type Endpoint struct {
+	Address  string     `json:"address"`            // IPv4 or IPv6.
+	Port     int        `json:"port,omitempty"`     // 0 when not set.
+	Protocol string     `json:"protocol,omitempty"` // tcp, udp or empty when not set.
+	Weight   int        `json:"weight,omitempty"`   // Relative weight, 0 means 1.
+	Tags     []string   `json:"tags,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"` // The endpoint is ignored after this date.
+}
+
+// String returns the endpoint address with its port, if any.
+// ex: 10.0.0.2, 10.0.0.2:80, fd00::2 or [fd00::2]:80.
+func (e Endpoint) String() string {
+	if e.Port == 0 {
+		return e.Address
+	}
+	return net.JoinHostPort(e.Address, strconv.Itoa(e.Port))
+}
+
+// Expired checks if the endpoint expired at the given time.
+func (e Endpoint) Expired(now time.Time) bool {
+	return e.Expires != nil && !now.Before(*e.Expires)
+}
+
+// validate checks the endpoint fields.
+func (e Endpoint) validate() error {
+	if net.ParseIP(e.Address) == nil {
+		return fmt.Errorf("invalid ip %q", e.Address)
+	}
+	if e.Port < 0 || e.Port > 65535 {
+		return fmt.Errorf("invalid port %d", e.Port)
+	}
+	if e.Protocol != "" && e.Protocol != "tcp" && e.Protocol != "udp" {
+		return fmt.Errorf("invalid protocol %q", e.Protocol)
+	}
+	if e.Weight < 0 {
+		return fmt.Errorf("invalid weight %d", e.Weight)
+	}
+	return nil
+}
+
+// discoveryFile is the JSON discovery file format.
+type discoveryFile struct {
+	Version   int        `json:"version"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// LookupLocalService looks for the endpoints of the given service in the discovery list.
+// The file name should be the service name. Two forms are supported:
+// - text: one address per line, same format as LookupLocalServiceIP. Empty lines and # comments are ignored.
+// - JSON: {"version": 1, "endpoints": [{"address": "10.0.0.2", "port": 80, "protocol": "tcp", "weight": 1, "tags": ["a"], "expires": "2006-01-02T15:04:05Z"}]}
+// Expired endpoints are skipped.
+// Returns a *MissingServiceError when the file is not present or when all the endpoints expired
+// and an *InvalidServiceError when its content is invalid.
+func LookupLocalService(service, pth string) ([]Endpoint, error) {
+	buf, err := ioutil.ReadFile(path.Join(pth, service))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &MissingServiceError{Service: service}
+		}
+		return nil, err
+	}
+	endpoints, err := parseDiscoveryFile(service, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	healthy := endpoints[:0]
+	for _, endpoint := range endpoints {
+		if !endpoint.Expired(now) {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, &MissingServiceError{Service: service}
+	}
+	return healthy, nil
+}
+
+// parseDiscoveryFile parses the text or JSON discovery file content.
+// Fails on the first invalid entry.
+func parseDiscoveryFile(service string, buf []byte) ([]Endpoint, error) {
+	endpoints, invalid := parseDiscoveryEntries(service, buf)
+	if len(invalid) > 0 {
+		return nil, invalid[0]
+	}
+	if len(endpoints) == 0 {
+		return nil, &InvalidServiceError{Service: service, Entry: string(bytes.TrimSpace(buf)), Err: errors.New("no endpoint")}
+	}
+	return endpoints, nil
+}
+
+// parseDiscoveryEntries parses the text or JSON discovery file content.
+// Returns the valid endpoints along with the invalid entries, which are skipped.
+// An unreadable JSON file is a single invalid entry.
+func parseDiscoveryEntries(service string, buf []byte) ([]Endpoint, []*InvalidServiceError) {
+	content := bytes.TrimSpace(buf)
+	if bytes.HasPrefix(content, []byte("{")) {
+		return parseDiscoveryJSON(service, content)
+	}
+
+	var (
+		endpoints []Endpoint
+		invalid   []*InvalidServiceError
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		endpoint, err := parseServiceAddr(line)
+		if err != nil {
+			invalid = append(invalid, &InvalidServiceError{Service: service, Entry: line, Err: err})
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, []*InvalidServiceError{{Service: service, Entry: string(content), Err: err}}
+	}
+	return endpoints, invalid
+}
+
+// parseDiscoveryJSON parses the JSON discovery file content. See parseDiscoveryEntries.
+func parseDiscoveryJSON(service string, content []byte) ([]Endpoint, []*InvalidServiceError) {
+	var file discoveryFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, []*InvalidServiceError{{Service: service, Entry: string(content), Err: err}}
+	}
+	if file.Version != DiscoveryFileVersion {
+		return nil, []*InvalidServiceError{{Service: service, Entry: string(content), Err: fmt.Errorf("unsupported version %d", file.Version)}}
+	}
+	var (
+		endpoints []Endpoint
+		invalid   []*InvalidServiceError
+	)
+	for _, endpoint := range file.Endpoints {
+		if err := endpoint.validate(); err != nil {
+			invalid = append(invalid, &InvalidServiceError{Service: service, Entry: endpoint.String(), Err: err})
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, invalid
+}
+
+// parseServiceAddr parses the given ip or host:port address.
+// IPv6 addresses with a port are expected to be bracketed.
+func parseServiceAddr(addr string) (Endpoint, error) {
+	if net.ParseIP(addr) != nil {
+		return Endpoint{Address: addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if net.ParseIP(host) == nil {
+		return Endpoint{}, fmt.Errorf("invalid ip %q", host)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return Endpoint{}, fmt.Errorf("invalid port %q", port)
+	}
+	return Endpoint{Address: host, Port: n}, nil
+}
@@ -0,0 +1,60 @@
+package discoverclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLookupLocalService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for _, tc := range []struct {
+		content string
+		expect  []string // Endpoint addresses, nil for an error.
+	}{
+		{content: "10.0.0.2\n", expect: []string{"10.0.0.2"}},
+		{content: "# replicas\n10.0.0.2:80\n\n[fd00::2]:80\n", expect: []string{"10.0.0.2:80", "[fd00::2]:80"}},
+		{content: `{"version": 1, "endpoints": [{"address": "10.0.0.2", "port": 80, "protocol": "tcp", "weight": 2, "tags": ["a"]}, {"address": "fd00::3"}]}`, expect: []string{"10.0.0.2:80", "fd00::3"}},
+		{content: `{"version": 1, "endpoints": [{"address": "10.0.0.2", "expires": "` + past + `"}, {"address": "10.0.0.3"}]}`, expect: []string{"10.0.0.3"}},
+		{content: "10.0.0.2\nnope\n"},
+		{content: "\n"},
+		{content: `{"version": 2, "endpoints": [{"address": "10.0.0.2"}]}`},
+		{content: `{"version": 1, "endpoints": [{"address": "10.0.0.2", "protocol": "sctp"}]}`},
+	} {
+		writeFile(t, filepath.Join(dir, "db"), tc.content)
+		endpoints, err := LookupLocalService("db", dir)
+		if tc.expect == nil {
+			if !IsInvalidService(err) {
+				t.Fatalf("Expected an invalid service error for %q, got: %v", tc.content, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", tc.content, err)
+		}
+		var addrs []string
+		for _, endpoint := range endpoints {
+			addrs = append(addrs, endpoint.String())
+		}
+		if !reflect.DeepEqual(addrs, tc.expect) {
+			t.Fatalf("Unexpected endpoints for %q.\nExpected: %v\nGot:      %v", tc.content, tc.expect, addrs)
+		}
+		if ip, err := LookupLocalServiceIP("db", dir); err != nil || ip != tc.expect[0] {
+			t.Fatalf("Unexpected first endpoint for %q: %s (%v)", tc.content, ip, err)
+		}
+	}
+
+	writeFile(t, filepath.Join(dir, "db"), `{"version": 1, "endpoints": [{"address": "10.0.0.2", "expires": "`+past+`"}]}`)
+	if _, err := LookupLocalService("db", dir); !IsMissingService(err) {
+		t.Fatalf("Expected a missing service error when all the endpoints expired, got: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package discoverclient
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the lookups.
+var (
+	ErrBadRequest         = errors.New("bad request")
+	ErrContainerNotFound  = errors.New("container not found")
+	ErrNotExposed         = errors.New("port not exposed")
+	ErrNotPublished       = errors.New("port exposed but not published")
+	ErrBackendUnavailable = errors.New("discover backend unavailable")
+	ErrContainerUnhealthy = errors.New("container not healthy")
+	ErrAmbiguousCaller    = errors.New("caller matches several containers")
+)
+
+// ErrorCode is the machine readable code of an API error.
+type ErrorCode string
+
+// API error codes.
+const (
+	CodeBadRequest         ErrorCode = "bad_request"
+	CodeContainerNotFound  ErrorCode = "container_not_found"
+	CodeNotExposed         ErrorCode = "not_exposed"
+	CodeBackendUnavailable ErrorCode = "backend_unavailable"
+	CodeContainerUnhealthy ErrorCode = "container_unhealthy"
+	CodeAmbiguousCaller    ErrorCode = "ambiguous_caller"
+	CodeNotFound           ErrorCode = "not_found"
+	CodeMethodNotAllowed   ErrorCode = "method_not_allowed"
+	CodeInternal           ErrorCode = "internal"
+)
+
+// codeErrors maps the API error codes to the client sentinel errors.
+var codeErrors = map[ErrorCode]error{
+	CodeBadRequest:         ErrBadRequest,
+	CodeContainerNotFound:  ErrContainerNotFound,
+	CodeNotExposed:         ErrNotExposed,
+	CodeBackendUnavailable: ErrBackendUnavailable,
+	CodeContainerUnhealthy: ErrContainerUnhealthy,
+	CodeAmbiguousCaller:    ErrAmbiguousCaller,
+}
+
+// APIError is an error returned by the discover service.
+type APIError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// ErrorResponse is the envelope of the errors returned by the discover service.
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// MissingServiceError is returned when the discovery file of a service is not present.
+type MissingServiceError struct {
+	Service string
+}
+
+// Error implements the error interface.
+func (e *MissingServiceError) Error() string {
+	return fmt.Sprintf("discovery file not present for %s", e.Service)
+}
+
+// InvalidServiceError is returned when the discovery file of a service is invalid.
+type InvalidServiceError struct {
+	Service string
+	Entry   string // Invalid content.
+	Err     error
+}
+
+// Error implements the error interface.
+func (e *InvalidServiceError) Error() string {
+	return fmt.Sprintf("invalid service ip for %s (%s): %s", e.Service, e.Entry, e.Err)
+}
+
+// IsMissingService checks if the error reports a missing discovery file.
+func IsMissingService(err error) bool {
+	_, ok := err.(*MissingServiceError)
+	return ok
+}
+
+// IsInvalidService checks if the error reports an invalid discovery file.
+func IsInvalidService(err error) bool {
+	_, ok := err.(*InvalidServiceError)
+	return ok
+}
+
+// WatchError is reported when the discovery directory can't be watched.
+type WatchError struct {
+	Path string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *WatchError) Error() string {
+	return fmt.Sprintf("error watching %s: %s", e.Path, e.Err)
+}
@@ -0,0 +1,32 @@
+package discoverclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestResponseError(t *testing.T) {
+	for code, expect := range codeErrors {
+		body, err := json.Marshal(ErrorResponse{Error: &APIError{Code: code, Message: "message"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := responseError(http.StatusConflict, body); err != expect {
+			t.Fatalf("Unexpected error for %s.\nExpected: %v\nGot:      %v", code, expect, err)
+		}
+	}
+
+	// Unknown codes and bodies are reported as is.
+	for _, body := range []string{`{"error":{"code":"internal","message":"boom"}}`, `{}`, `404 page not found`} {
+		err := responseError(http.StatusInternalServerError, []byte(body))
+		if err == nil {
+			t.Fatalf("Expected error for %s", body)
+		}
+		for _, sentinel := range codeErrors {
+			if err == sentinel {
+				t.Fatalf("Unexpected typed error for %s: %v", body, err)
+			}
+		}
+	}
+}
@@ -2,88 +2,128 @@ package discoverclient
 
 // LookupLocalServiceIP look for the given service's ip
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net"
-	"os"
-	"path"
-	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/go-fsnotify/fsnotify"
 )
 
-// WatchService start a watcher on the given service.
-// Execute preHook right away and after each event on the target service.
-// Execute postHook only after the event.
-func WatchService(preHook, postHook func(ip string), service, discoveryPath string, stopChan <-chan struct{}) {
-	if discoveryPath == "" || service == "" || preHook == nil || stopChan == nil {
-		logrus.Errorf("WatchService fail for %q: preHook, service, discoveryPath and stopChan are mandatory", service)
-		return
+// WatchHooks are the callbacks of a service watch.
+// Nil callbacks are ignored. No callback is called when the service is unchanged.
+type WatchHooks struct {
+	OnAdd    func(addr string)             // The service appeared.
+	OnChange func(oldAddr, newAddr string) // The service address changed.
+	OnRemove func(oldAddr string)          // The service disappeared.
+	OnError  func(err error)               // Invalid discovery file or watch error. The service is kept as is.
+
+	Mode         WatchMode     // Watch backend, see Watcher.Mode.
+	PollInterval time.Duration // Polling period, see Watcher.PollInterval.
+}
+
+// dispatch calls the hooks matching the given update.
+func (h WatchHooks) dispatch(u Update) {
+	switch {
+	case u.Service == "" || (u.Err != nil && !IsMissingService(u.Err)):
+		if h.OnError != nil {
+			h.OnError(u.Err)
+		}
+	case u.Old == "" && u.New != "":
+		if h.OnAdd != nil {
+			h.OnAdd(u.New)
+		}
+	case u.Old != "" && u.New == "":
+		if h.OnRemove != nil {
+			h.OnRemove(u.Old)
+		}
+	case u.Old != u.New:
+		if h.OnChange != nil {
+			h.OnChange(u.Old, u.New)
+		}
 	}
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatal(err)
+}
+
+// WatchServiceHooks watches the given service and calls the hooks upon change until the context is done.
+// OnAdd is called right away if the service is present. Returns the context error.
+// See Watcher to watch multiple services.
+func WatchServiceHooks(ctx context.Context, service, discoveryPath string, hooks WatchHooks) error {
+	if discoveryPath == "" || service == "" {
+		return fmt.Errorf("WatchService fail for %q: service and discoveryPath are mandatory", service)
 	}
-	defer func() { _ = watcher.Close() }() // Best effort.
+	watcher := NewWatcher(discoveryPath, service)
+	watcher.Mode = hooks.Mode
+	if hooks.PollInterval > 0 {
+		watcher.PollInterval = hooks.PollInterval
+	}
+	go func() { _ = watcher.Run(ctx) }() // Only fails when ctx is done.
 
-	watcher.Add(discoveryPath)
-	path := path.Join(discoveryPath, service)
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-	for {
-		ip, err := LookupLocalServiceIP(service, discoveryPath)
-		if err != nil {
-			// TODO:  handle error.
-		}
-		preHook(ip)
+	for u := range watcher.Updates() {
+		hooks.dispatch(u)
+	}
+	return ctx.Err()
+}
+
+// WatchService start a watcher on the given service.
+// Execute preHook right away if the service is present, then when it appears
+// and after each change of the target service with the new value.
+// Execute postHook after each change or removal with the previous value.
+// Lookup and watch errors are logged, see WatchServiceWithErrors.
+func WatchService(preHook, postHook func(ip string), service, discoveryPath string, stopChan <-chan struct{}) error {
+	return WatchServiceWithErrors(preHook, postHook, func(err error) {
+		logrus.WithError(err).WithField("service", service).Error("watch service error")
+	}, service, discoveryPath, stopChan)
+}
 
-	wait:
-		/// Wait for an event
+// WatchServiceWithErrors start a watcher on the given service.
+// Execute preHook right away if the service is present, then when it appears
+// and after each change of the target service with the new value.
+// Execute postHook after each change or removal with the previous value.
+// Invalid discovery file and watch errors are reported to onError.
+// Blocks until stopChan is closed. Returns an error if the parameters are invalid.
+// See WatchServiceHooks.
+func WatchServiceWithErrors(preHook, postHook func(ip string), onError func(error), service, discoveryPath string, stopChan <-chan struct{}) error {
+	if preHook == nil || onError == nil || stopChan == nil {
+		return fmt.Errorf("WatchService fail for %q: preHook, onError, service, discoveryPath and stopChan are mandatory", service)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
 		select {
-		case <-ticker.C:
 		case <-stopChan:
-			return
-		case event, open := <-watcher.Events:
-			if !open {
-				return
-			}
-			if event.Name != path {
-				goto wait
-			}
-		case err, open := <-watcher.Errors:
-			if !open {
-				return
-			}
-			// TODO: handle errors.
-			_ = err
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
 
-		// TODO: create a post hook? (for Close())
-		if postHook != nil {
-			postHook(ip)
-		}
+	hooks := WatchHooks{
+		OnAdd: preHook,
+		OnChange: func(oldIP, newIP string) {
+			if postHook != nil {
+				postHook(oldIP)
+			}
+			preHook(newIP)
+		},
+		OnRemove: postHook,
+		OnError:  onError,
 	}
+	if err := WatchServiceHooks(ctx, service, discoveryPath, hooks); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
 }
 
 // LookupLocalServiceIP look for the given service's ip
 // in the discovery list.
-// Expect to be a single line file containing the IPv4.
+// Returns the first healthy endpoint, see LookupLocalService for the file format.
+// Returns a *MissingServiceError when the file is not present
+// and an *InvalidServiceError when its content is invalid.
+// The address is the IPv4 or IPv6, optionally with a port:
+// 10.0.0.2, 10.0.0.2:80, fd00::2 or [fd00::2]:80.
 // The file name should be the service name.
 func LookupLocalServiceIP(service, pth string) (string, error) {
-	buf, err := ioutil.ReadFile(path.Join(pth, service))
+	endpoints, err := LookupLocalService(service, pth)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return "", fmt.Errorf("discovery file not present for %s", service)
-		}
 		return "", err
 	}
-	ipStr := strings.TrimSpace(string(buf))
-	// validate the ip
-	if _, _, err := net.ParseCIDR(strings.Split(ipStr, ":")[0] + "/32"); err != nil {
-		return "", fmt.Errorf("invalid service ip (%s): %s", ipStr, err)
-	}
-	return ipStr, nil
+	return endpoints[0].String(), nil
 }
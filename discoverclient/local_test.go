@@ -0,0 +1,175 @@
+package discoverclient
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchHooksDispatch(t *testing.T) {
+	var calls []string
+	hooks := WatchHooks{
+		OnAdd:    func(addr string) { calls = append(calls, "add "+addr) },
+		OnChange: func(oldAddr, newAddr string) { calls = append(calls, "change "+oldAddr+" "+newAddr) },
+		OnRemove: func(oldAddr string) { calls = append(calls, "remove "+oldAddr) },
+		OnError:  func(err error) { calls = append(calls, "error "+err.Error()) },
+	}
+	invalid := &InvalidServiceError{Service: "db", Entry: "nope", Err: errors.New("invalid ip")}
+
+	for _, tc := range []struct {
+		update Update
+		expect string // Empty for no call.
+	}{
+		{update: Update{Service: "db", New: "10.0.0.2"}, expect: "add 10.0.0.2"},
+		{update: Update{Service: "db", Old: "10.0.0.2", New: "10.0.0.3"}, expect: "change 10.0.0.2 10.0.0.3"},
+		{update: Update{Service: "db", Old: "10.0.0.3"}, expect: "remove 10.0.0.3"},
+		{update: Update{Service: "db", Err: &MissingServiceError{Service: "db"}}},
+		{update: Update{Service: "db", Old: "10.0.0.3", New: "10.0.0.3"}},
+		{update: Update{Service: "db", Old: "10.0.0.3", New: "10.0.0.3", Err: invalid}, expect: "error " + invalid.Error()},
+		{update: Update{Err: errors.New("watch failed")}, expect: "error watch failed"},
+	} {
+		calls = nil
+		hooks.dispatch(tc.update)
+		var got string
+		if len(calls) > 1 {
+			t.Fatalf("Unexpected calls for %+v: %v", tc.update, calls)
+		}
+		if len(calls) == 1 {
+			got = calls[0]
+		}
+		if got != tc.expect {
+			t.Fatalf("Unexpected call for %+v.\nExpected: %q\nGot:      %q", tc.update, tc.expect, got)
+		}
+	}
+
+	// Nil hooks are ignored.
+	for _, u := range []Update{{Service: "db", New: "a"}, {Service: "db", Old: "a", New: "b"}, {Service: "db", Old: "b"}, {Err: errors.New("fail")}} {
+		WatchHooks{}.dispatch(u)
+	}
+}
+
+func TestWatchServiceWithErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.2:5432")
+
+	if err := WatchServiceWithErrors(nil, nil, func(error) {}, "db", dir, make(chan struct{})); err == nil {
+		t.Fatal("Expected error without preHook")
+	}
+	if err := WatchServiceWithErrors(func(string) {}, nil, nil, "db", dir, make(chan struct{})); err == nil {
+		t.Fatal("Expected error without onError")
+	}
+
+	calls := make(chan string, 10)
+	stopChan := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchServiceWithErrors(
+			func(ip string) { calls <- "pre " + ip },
+			func(ip string) { calls <- "post " + ip },
+			func(err error) { calls <- "error" },
+			"db", dir, stopChan,
+		)
+	}()
+	expectCall := func(expect string) {
+		select {
+		case call := <-calls:
+			if call != expect {
+				t.Fatalf("Unexpected hook call.\nExpected: %s\nGot:      %s", expect, call)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for %s", expect)
+		}
+	}
+
+	// preHook right away.
+	expectCall("pre 10.0.0.2:5432")
+	// postHook with the old value, then preHook with the new one.
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.3:5432")
+	expectCall("post 10.0.0.2:5432")
+	expectCall("pre 10.0.0.3:5432")
+	// Invalid files are reported, the service is kept as is.
+	writeFile(t, filepath.Join(dir, "db"), "nope")
+	expectCall("error")
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.3:5432")
+	// postHook upon removal.
+	if err := os.Remove(filepath.Join(dir, "db")); err != nil {
+		t.Fatal(err)
+	}
+	expectCall("post 10.0.0.3:5432")
+	// preHook when the service appears.
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.4:5432")
+	expectCall("pre 10.0.0.4:5432")
+
+	close(stopChan)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the watch to stop")
+	}
+	select {
+	case call := <-calls:
+		t.Fatalf("Unexpected hook call: %s", call)
+	default:
+	}
+}
+
+func TestWatchServiceWatchError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	missing := filepath.Join(dir, "missing")
+
+	// The discovery directory does not exist yet: the error is reported
+	// and the watch is retried instead of exiting.
+	calls := make(chan string, 10)
+	errs := make(chan error, 10)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go func() {
+		_ = WatchServiceWithErrors(
+			func(ip string) { calls <- "pre " + ip },
+			nil,
+			func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			"db", missing, stopChan,
+		)
+	}()
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(*WatchError); !ok {
+			t.Fatalf("Expected a watch error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the watch error")
+	}
+
+	if err := os.Mkdir(missing, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(missing, "db"), "10.0.0.2")
+	select {
+	case call := <-calls:
+		if call != "pre 10.0.0.2" {
+			t.Fatalf("Unexpected hook call: %s", call)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the service")
+	}
+}
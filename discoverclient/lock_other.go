@@ -0,0 +1,31 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package discoverclient
+
+import (
+	"sync"
+)
+
+// serviceLocks serializes the writers of the current process where flock is not available.
+var serviceLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: map[string]*sync.Mutex{}}
+
+// lockService takes the in-process lock of the given service discovery file.
+// flock is not available on this platform: writers from other processes are not excluded.
+// Blocks until the lock is acquired. Returns the release function.
+func lockService(service, pth string) (func(), error) {
+	key := pth + "/" + service
+	serviceLocks.Lock()
+	lock, ok := serviceLocks.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		serviceLocks.locks[key] = lock
+	}
+	serviceLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock, nil
+}
@@ -0,0 +1,28 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package discoverclient
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockService takes the advisory lock of the given service discovery file.
+// The lock is a separate dot file as the discovery file itself is replaced upon write.
+// Blocks until the lock is acquired. Returns the release function.
+func lockService(service, pth string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(pth, lockFileName(service)), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		_ = f.Close() // Best effort.
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN) // Best effort, released on close anyway.
+		_ = f.Close()                                   // Best effort.
+	}, nil
+}
@@ -0,0 +1,231 @@
+package discoverclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ParseEndpoint parses the given address in the format accepted by LookupLocalServiceIP:
+// 10.0.0.2, 10.0.0.2:80, fd00::2 or [fd00::2]:80.
+func ParseEndpoint(addr string) (Endpoint, error) {
+	return parseServiceAddr(strings.TrimSpace(addr))
+}
+
+// RegisterLocalService adds the given endpoints to the discovery file of the service.
+// Endpoints with the same address, port and protocol as an existing one replace it.
+// Expired endpoints are dropped.
+// The file is written atomically under an advisory lock so readers never see a partial file
+// and concurrent writers don't lose entries.
+// The lock is a .<service>.lock file next to the discovery file. It is kept on purpose,
+// removing it would race with the other writers. The Watcher ignores it.
+// The invalid entries of the current file are logged and dropped.
+// Uses the text format when the endpoints only have an address and a port, the JSON format otherwise.
+func RegisterLocalService(service, pth string, endpoints ...Endpoint) error {
+	if err := validateEndpoints("register", service, endpoints); err != nil {
+		return err
+	}
+	return updateLocalService(service, pth, func(current []Endpoint) []Endpoint {
+		for _, endpoint := range endpoints {
+			current = append(removeEndpoint(current, endpoint), endpoint)
+		}
+		return current
+	})
+}
+
+// ReplaceLocalService replaces the endpoints of the discovery file of the service, creating it if needed.
+// The current content is not read, an invalid file is overwritten.
+// Same lock and atomic write as RegisterLocalService: watchers never see the file missing nor partial.
+func ReplaceLocalService(service, pth string, endpoints ...Endpoint) error {
+	if err := validateEndpoints("replace", service, endpoints); err != nil {
+		return err
+	}
+	return writeLocalService(service, pth, endpoints)
+}
+
+// validateEndpoints checks there is at least one endpoint and that they are valid.
+func validateEndpoints(op, service string, endpoints []Endpoint) error {
+	if len(endpoints) == 0 {
+		return fmt.Errorf("%s %q: no endpoint", op, service)
+	}
+	for _, endpoint := range endpoints {
+		if err := endpoint.validate(); err != nil {
+			return &InvalidServiceError{Service: service, Entry: endpoint.String(), Err: err}
+		}
+	}
+	return nil
+}
+
+// DeregisterLocalService removes the given endpoints from the discovery file of the service.
+// The file is removed when no endpoint is given, even if invalid, or when no endpoint remains.
+// Not an error if the file or the endpoints are not present.
+// The invalid entries of the current file are logged and dropped.
+func DeregisterLocalService(service, pth string, endpoints ...Endpoint) error {
+	if len(endpoints) == 0 {
+		return writeLocalService(service, pth, nil)
+	}
+	return updateLocalService(service, pth, func(current []Endpoint) []Endpoint {
+		for _, endpoint := range endpoints {
+			current = removeEndpoint(current, endpoint)
+		}
+		return current
+	})
+}
+
+// removeEndpoint removes the endpoints with the same address, port and protocol as the given one.
+func removeEndpoint(endpoints []Endpoint, endpoint Endpoint) []Endpoint {
+	kept := endpoints[:0]
+	for _, elem := range endpoints {
+		if elem.Address != endpoint.Address || elem.Port != endpoint.Port || elem.Protocol != endpoint.Protocol {
+			kept = append(kept, elem)
+		}
+	}
+	return kept
+}
+
+// updateLocalService applies the given update to the service endpoints under the service lock.
+// The invalid entries of the current file are logged and dropped.
+// Writes the result atomically, or removes the file when empty.
+func updateLocalService(service, pth string, update func([]Endpoint) []Endpoint) error {
+	return lockedLocalService(service, pth, func(filePath string) error {
+		buf, err := ioutil.ReadFile(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		current, invalid := parseDiscoveryEntries(service, buf)
+		for _, err := range invalid {
+			logrus.WithError(err).WithField("service", service).Warn("dropping the invalid discovery file entry")
+		}
+		return writeEndpoints(filePath, update(current))
+	})
+}
+
+// writeLocalService replaces the service endpoints under the service lock without reading the current file.
+// Writes them atomically, or removes the file when empty.
+func writeLocalService(service, pth string, endpoints []Endpoint) error {
+	return lockedLocalService(service, pth, func(filePath string) error {
+		return writeEndpoints(filePath, endpoints)
+	})
+}
+
+// lockedLocalService calls fn with the discovery file path of the service under the service lock.
+func lockedLocalService(service, pth string, fn func(filePath string) error) error {
+	if err := validateServiceName(service); err != nil {
+		return err
+	}
+	unlock, err := lockService(service, pth)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn(filepath.Join(pth, service))
+}
+
+// writeEndpoints writes the unexpired endpoints to the given discovery file atomically,
+// or removes it when none is left.
+func writeEndpoints(filePath string, endpoints []Endpoint) error {
+	now := time.Now()
+	var unexpired []Endpoint
+	for _, endpoint := range endpoints {
+		if !endpoint.Expired(now) {
+			unexpired = append(unexpired, endpoint)
+		}
+	}
+	if len(unexpired) == 0 {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, err := formatDiscoveryFile(unexpired)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, content)
+}
+
+// lockFileName returns the name of the lock file of the given service.
+func lockFileName(service string) string {
+	return "." + service + ".lock"
+}
+
+// isInternalFile checks if the given file name is a lock or temporary file of the writers.
+func isInternalFile(name string) bool {
+	return strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "..") &&
+		(strings.HasSuffix(name, ".lock") || strings.Contains(name, ".tmp"))
+}
+
+// validateServiceName checks the service name is a plain file name.
+// Names starting with a dot are reserved for the temporary and lock files.
+func validateServiceName(service string) error {
+	if service == "" || strings.HasPrefix(service, ".") || strings.ContainsAny(service, `/\`) {
+		return fmt.Errorf("invalid service name %q", service)
+	}
+	return nil
+}
+
+// formatDiscoveryFile formats the given endpoints in the text format when possible, JSON otherwise.
+func formatDiscoveryFile(endpoints []Endpoint) ([]byte, error) {
+	text := true
+	for _, endpoint := range endpoints {
+		if endpoint.Protocol != "" || endpoint.Weight != 0 || len(endpoint.Tags) > 0 || endpoint.Expires != nil {
+			text = false
+			break
+		}
+	}
+	if !text {
+		buf, err := json.MarshalIndent(discoveryFile{Version: DiscoveryFileVersion, Endpoints: endpoints}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, '\n'), nil
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, endpoint := range endpoints {
+		fmt.Fprintln(buf, endpoint.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFileAtomic writes the given content to a temporary file, syncs it and renames it into place.
+func writeFileAtomic(filePath string, content []byte) (err error) {
+	dir, name := filepath.Dir(filePath), filepath.Base(filePath)
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()           // Best effort.
+			_ = os.Remove(f.Name()) // Best effort.
+		}
+	}()
+	if _, err := f.Write(content); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filePath); err != nil {
+		return err
+	}
+	// Persist the rename.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()  // Best effort.
+		_ = d.Close() // Best effort.
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package discoverclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegisterLocalService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	endpoint, err := ParseEndpoint("[fd00::2]:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterLocalService("db", dir, endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := LookupLocalServiceIP("db", dir); err != nil || ip != "[fd00::2]:5432" {
+		t.Fatalf("Unexpected address: %s (%v)", ip, err)
+	}
+
+	// Concurrent writers don't lose entries.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := RegisterLocalService("db", dir, Endpoint{Address: fmt.Sprintf("10.0.0.%d", i), Weight: 1}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	endpoints, err := LookupLocalService("db", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := 21; len(endpoints) != expect {
+		t.Fatalf("Unexpected endpoint count.\nExpected: %d\nGot:      %d", expect, len(endpoints))
+	}
+
+	if err := DeregisterLocalService("db", dir, endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if endpoints, err := LookupLocalService("db", dir); err != nil || len(endpoints) != 20 {
+		t.Fatalf("Unexpected endpoints after deregister: %v (%v)", endpoints, err)
+	}
+	if err := DeregisterLocalService("db", dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupLocalService("db", dir); !IsMissingService(err) {
+		t.Fatalf("Expected a missing service error, got: %v", err)
+	}
+
+	if _, err := ParseEndpoint("10.0.0.2:0"); err == nil {
+		t.Fatal("Expected an error for an invalid port")
+	}
+	if err := RegisterLocalService("../db", dir, endpoint); err == nil {
+		t.Fatal("Expected an error for an invalid service name")
+	}
+}
+
+func TestInternalFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	if err := RegisterLocalService("db", dir, Endpoint{Address: "10.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if fi.Name() != "db" && !isInternalFile(fi.Name()) {
+			t.Fatalf("Unexpected file left by the writer: %s", fi.Name())
+		}
+	}
+
+	for name, expect := range map[string]bool{
+		".db.lock":      true,
+		".db.tmp123":    true,
+		"db":            false,
+		"db.lock":       false,
+		"..data":        false,
+		"..data_tmp":    false,
+		".hidden":       false,
+		"..2017_01.tmp": false,
+	} {
+		if got := isInternalFile(name); got != expect {
+			t.Fatalf("Unexpected internal file check for %s.\nExpected: %t\nGot:      %t", name, expect, got)
+		}
+	}
+}
+
+func TestReplaceLocalService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	if err := RegisterLocalService("db", dir, Endpoint{Address: "10.0.0.2"}, Endpoint{Address: "10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplaceLocalService("db", dir, Endpoint{Address: "10.0.0.4", Port: 5432}); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "db")); err != nil || string(buf) != "10.0.0.4:5432\n" {
+		t.Fatalf("Unexpected discovery file: %q (%v)", buf, err)
+	}
+
+	for _, tc := range []struct {
+		service   string
+		endpoints []Endpoint
+	}{
+		{service: "db"},
+		{service: "db", endpoints: []Endpoint{{Address: "nope"}}},
+		{service: ".db", endpoints: []Endpoint{{Address: "10.0.0.2"}}},
+		{service: "../db", endpoints: []Endpoint{{Address: "10.0.0.2"}}},
+	} {
+		if err := ReplaceLocalService(tc.service, dir, tc.endpoints...); err == nil {
+			t.Fatalf("Expected error for %q %v", tc.service, tc.endpoints)
+		}
+	}
+
+	// Concurrent replacements and registrations don't corrupt the file.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if err := ReplaceLocalService("db", dir, Endpoint{Address: fmt.Sprintf("10.0.1.%d", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if err := RegisterLocalService("db", dir, Endpoint{Address: fmt.Sprintf("10.0.2.%d", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := RegisterLocalService("db", dir, Endpoint{Address: "10.0.3.1"}); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := LookupLocalService("db", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced := 0
+	for _, endpoint := range endpoints {
+		if strings.HasPrefix(endpoint.Address, "10.0.1.") {
+			replaced++
+		}
+	}
+	if last := endpoints[len(endpoints)-1]; replaced != 1 || last.Address != "10.0.3.1" {
+		t.Fatalf("Unexpected endpoints after the concurrent writes: %v", endpoints)
+	}
+}
+
+func TestUpdateCorruptService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	filePath := filepath.Join(dir, "web")
+	corrupt := func(content string) {
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LookupLocalService("web", dir); !IsInvalidService(err) {
+			t.Fatalf("Expected an invalid service error, got: %v", err)
+		}
+	}
+	expectFile := func(expect string) {
+		buf, err := ioutil.ReadFile(filePath)
+		if expect == "" {
+			if !os.IsNotExist(err) {
+				t.Fatalf("Unexpected discovery file: %q (%v)", buf, err)
+			}
+			return
+		}
+		if err != nil || string(buf) != expect {
+			t.Fatalf("Unexpected discovery file.\nExpected: %q\nGot:      %q (%v)", expect, buf, err)
+		}
+	}
+
+	// Replace and full deregister ignore the current content.
+	corrupt("10.0.0.\n")
+	if err := ReplaceLocalService("web", dir, Endpoint{Address: "10.0.0.2", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	expectFile("10.0.0.2:80\n")
+	corrupt("10.0.0.\n")
+	if err := DeregisterLocalService("web", dir); err != nil {
+		t.Fatal(err)
+	}
+	expectFile("")
+	corrupt(`{"version": 1, "endpoints": [`)
+	if err := DeregisterLocalService("web", dir); err != nil {
+		t.Fatal(err)
+	}
+	expectFile("")
+
+	// Register and partial deregister drop the invalid entries.
+	corrupt("10.0.0.\n10.0.0.3:80\n")
+	if err := RegisterLocalService("web", dir, Endpoint{Address: "10.0.0.2", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	expectFile("10.0.0.3:80\n10.0.0.2:80\n")
+	corrupt("10.0.0.3:80\n10.0.0.\n10.0.0.2:80\n")
+	if err := DeregisterLocalService("web", dir, Endpoint{Address: "10.0.0.3", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	expectFile("10.0.0.2:80\n")
+	corrupt("10.0.0.\n")
+	if err := DeregisterLocalService("web", dir, Endpoint{Address: "10.0.0.3", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	expectFile("")
+	corrupt(`{"version": 1, "endpoints": [{"address": "nope"}, {"address": "10.0.0.3", "port": 80}]}`)
+	if err := RegisterLocalService("web", dir, Endpoint{Address: "10.0.0.2", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	expectFile("10.0.0.3:80\n10.0.0.2:80\n")
+}
@@ -0,0 +1,465 @@
+package discoverclient
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+// Watcher defaults.
+const (
+	// DefaultWatchInterval is the default period of the full re-read of the watched services.
+	DefaultWatchInterval = 1 * time.Minute
+	// DefaultDebounce is the default delay between the last event on a service and its lookup.
+	DefaultDebounce = 100 * time.Millisecond
+	// DefaultPollInterval is the default period of the discovery files polling.
+	DefaultPollInterval = 2 * time.Second
+)
+
+// WatchMode selects how the changes of the discovery files are detected.
+type WatchMode int
+
+// Watch modes.
+const (
+	// WatchNotify uses inotify and falls back on polling while inotify is unavailable. Default.
+	WatchNotify WatchMode = iota
+	// WatchPoll polls the discovery files. For filesystems without inotify support (NFS, FUSE).
+	WatchPoll
+	// WatchHybrid uses both inotify and polling.
+	WatchHybrid
+)
+
+// String implements the fmt.Stringer interface.
+func (m WatchMode) String() string {
+	switch m {
+	case WatchPoll:
+		return "poll"
+	case WatchHybrid:
+		return "hybrid"
+	}
+	return "inotify"
+}
+
+// ParseWatchMode parses the given watch mode name: inotify, poll or hybrid.
+// Defaults to WatchNotify when empty.
+func ParseWatchMode(mode string) (WatchMode, error) {
+	switch mode {
+	case "", "inotify":
+		return WatchNotify, nil
+	case "poll":
+		return WatchPoll, nil
+	case "hybrid":
+		return WatchHybrid, nil
+	}
+	return WatchNotify, fmt.Errorf("invalid watch mode %q", mode)
+}
+
+// Watcher creation retry backoff.
+const (
+	watchMinBackoff = 100 * time.Millisecond
+	watchMaxBackoff = 30 * time.Second
+)
+
+// errWatcherClosed is reported when the inotify watcher channels close while watching.
+var errWatcherClosed = errors.New("inotify watcher closed")
+
+// Update is a change of a watched service.
+// Updates with an empty Service report watch errors.
+// A change of the endpoints other than the first one yields an update with Old and New equal.
+// An invalid discovery file keeps the previous address: Old and New are equal and Err is set.
+type Update struct {
+	Service string
+	Old     string // Previous address, empty if the service was missing.
+	New     string // New address, empty if the service is missing.
+	Err     error  // Lookup or watch error.
+
+	Endpoints []Endpoint // All the healthy endpoints of the service, New is the first one.
+}
+
+// serviceState is the last known state of a watched service.
+type serviceState struct {
+	resolved  bool   // False until the first lookup.
+	addr      string // Last valid address, empty if missing.
+	endpoints []Endpoint
+	key       string // Identifies the endpoints list.
+	err       string
+}
+
+// fileStamp identifies a version of a discovery file for the polling.
+type fileStamp struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+	hash    [sha1.Size]byte
+}
+
+// Watcher watches multiple services of a discovery directory
+// with a single fsnotify watcher and/or by polling, see WatchMode.
+// Supports in place writes, atomic rename into place, symlink retargeting
+// and the discovery directory being deleted and recreated.
+type Watcher struct {
+	// Interval is the period of the full re-read of the watched services,
+	// catching up missed events. Defaults to DefaultWatchInterval.
+	// Must be set before Run.
+	Interval time.Duration
+	// Debounce is the delay between the last event on a service and its lookup
+	// so a burst of events during a file rewrite yields a single update.
+	// Defaults to DefaultDebounce. Must be set before Run.
+	Debounce time.Duration
+	// Mode selects the watch backend. Defaults to WatchNotify.
+	// Must be set before Run.
+	Mode WatchMode
+	// PollInterval is the period of the polling in WatchPoll and WatchHybrid modes
+	// or when WatchNotify falls back on polling. Defaults to DefaultPollInterval.
+	// Must be set before Run.
+	PollInterval time.Duration
+
+	dir     string
+	updates chan Update
+	wake    chan struct{}
+
+	mu       sync.Mutex
+	services map[string]*serviceState
+}
+
+// NewWatcher instantiates a new Watcher on the given discovery directory.
+// Call Run to start watching.
+func NewWatcher(discoveryPath string, services ...string) *Watcher {
+	w := &Watcher{
+		Interval:     DefaultWatchInterval,
+		Debounce:     DefaultDebounce,
+		Mode:         WatchNotify,
+		PollInterval: DefaultPollInterval,
+		dir:          filepath.Clean(discoveryPath),
+		updates:      make(chan Update),
+		wake:         make(chan struct{}, 1),
+		services:     map[string]*serviceState{},
+	}
+	for _, service := range services {
+		w.services[service] = &serviceState{}
+	}
+	return w
+}
+
+// Updates returns the channel of the service updates.
+// An update is sent for the initial state of each service,
+// then only when the resolved value changes.
+// Closed when Run returns.
+func (w *Watcher) Updates() <-chan Update {
+	return w.updates
+}
+
+// Add starts watching the given service. Can be called while running.
+func (w *Watcher) Add(service string) {
+	w.mu.Lock()
+	if _, ok := w.services[service]; !ok {
+		w.services[service] = &serviceState{}
+	}
+	w.mu.Unlock()
+	w.notify()
+}
+
+// Remove stops watching the given service.
+func (w *Watcher) Remove(service string) {
+	w.mu.Lock()
+	delete(w.services, service)
+	w.mu.Unlock()
+}
+
+// watched checks if the given service is watched.
+func (w *Watcher) watched(service string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.services[service]
+	return ok
+}
+
+// list returns the watched services.
+// When newOnly is set, only the services never resolved are returned.
+func (w *Watcher) list(newOnly bool) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	services := make([]string, 0, len(w.services))
+	for service, state := range w.services {
+		if !newOnly || !state.resolved {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// notify wakes up the Run loop to resolve the new services.
+func (w *Watcher) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run watches the services until the context is done.
+// In WatchNotify and WatchHybrid modes, the inotify watcher creation is retried with backoff
+// upon failure or when the watcher closes unexpectedly, reporting a *WatchError update each time.
+// The services are polled meanwhile.
+// Returns the context error.
+func (w *Watcher) Run(ctx context.Context) error {
+	defer close(w.updates)
+
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	debounceDelay := w.Debounce
+	if debounceDelay <= 0 {
+		debounceDelay = DefaultDebounce
+	}
+	pollInterval := w.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		fsWatcher *fsnotify.Watcher
+		events    <-chan fsnotify.Event
+		errs      <-chan error
+		retry     <-chan time.Time // Next inotify watcher creation attempt.
+		backoff   = watchMinBackoff
+
+		pollTicker *time.Ticker
+		poll       <-chan time.Time
+		stamps     = map[string]fileStamp{}
+
+		pending    = map[string]struct{}{} // Services with events within the debounce window.
+		pendingAll bool                    // Refresh all the services after the debounce window.
+		debounce   <-chan time.Time
+	)
+	startPolling := func() {
+		if pollTicker == nil {
+			pollTicker = time.NewTicker(pollInterval)
+			poll = pollTicker.C
+		}
+	}
+	stopPolling := func() {
+		if pollTicker != nil {
+			pollTicker.Stop()
+			pollTicker, poll = nil, nil
+		}
+	}
+	closeWatcher := func() {
+		if fsWatcher != nil {
+			_ = fsWatcher.Close() // Best effort.
+			fsWatcher, events, errs = nil, nil, nil
+		}
+	}
+	defer stopPolling()
+	defer closeWatcher()
+
+	// fallback reports the given inotify error, falls back on polling and schedules a retry.
+	fallback := func(err error) {
+		w.send(ctx, Update{Err: err})
+		startPolling()
+		retry = time.After(backoff)
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+	// watch creates the inotify watcher. Falls back on polling upon failure.
+	watch := func() {
+		var err error
+		if fsWatcher, err = openFSWatcher(w.dir); err != nil {
+			fallback(err)
+			return
+		}
+		events, errs = fsWatcher.Events, fsWatcher.Errors
+		retry, backoff = nil, watchMinBackoff
+		if w.Mode != WatchHybrid {
+			stopPolling()
+		}
+	}
+
+	if w.Mode == WatchPoll || w.Mode == WatchHybrid {
+		startPolling()
+	}
+	if w.Mode != WatchPoll {
+		watch()
+	}
+	w.refresh(ctx, false)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			w.refresh(ctx, false)
+		case <-w.wake:
+			w.refresh(ctx, true)
+		case <-poll:
+			w.poll(ctx, stamps)
+		case <-retry:
+			if watch(); fsWatcher != nil {
+				// Catch up the changes made while not watching.
+				w.refresh(ctx, false)
+			}
+		case <-debounce:
+			if pendingAll {
+				w.refresh(ctx, false)
+			} else {
+				for service := range pending {
+					w.refreshService(ctx, service)
+				}
+			}
+			pending, pendingAll, debounce = map[string]struct{}{}, false, nil
+		case event, open := <-events:
+			if !open {
+				// The inotify watcher died, poll until it is recreated.
+				closeWatcher()
+				fallback(&WatchError{Path: w.dir, Err: errWatcherClosed})
+				continue
+			}
+			if event.Name == w.dir {
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+					continue
+				}
+				// The directory is gone, the services are missing until it is recreated.
+				closeWatcher()
+				w.refresh(ctx, false)
+				watch()
+				continue
+			}
+			if filepath.Dir(event.Name) != w.dir {
+				continue
+			}
+			// Events on other files may be a rename into place or a symlink swap
+			// of a parent entry (ex: kubernetes ConfigMap ..data), refresh everything.
+			// The lock and temporary files of the writers are not, the rename yields its own event.
+			name := filepath.Base(event.Name)
+			if isInternalFile(name) {
+				continue
+			}
+			if w.watched(name) {
+				pending[name] = struct{}{}
+			} else {
+				pendingAll = true
+			}
+			debounce = time.After(debounceDelay)
+		case err, open := <-errs:
+			if !open {
+				closeWatcher()
+				fallback(&WatchError{Path: w.dir, Err: errWatcherClosed})
+				continue
+			}
+			w.send(ctx, Update{Err: err})
+		}
+	}
+}
+
+// refresh looks up all the watched services.
+// When newOnly is set, only the services never resolved are looked up.
+func (w *Watcher) refresh(ctx context.Context, newOnly bool) {
+	for _, service := range w.list(newOnly) {
+		w.refreshService(ctx, service)
+	}
+}
+
+// poll checks the discovery files stat and looks up the services which changed.
+// The content hash is only computed when the modification time or the size changed,
+// same size rewrites within the modification time granularity are caught by the periodic full re-read.
+func (w *Watcher) poll(ctx context.Context, stamps map[string]fileStamp) {
+	services := w.list(false)
+	watched := make(map[string]struct{}, len(services))
+	for _, service := range services {
+		watched[service] = struct{}{}
+
+		pth := filepath.Join(w.dir, service)
+		old, known := stamps[service]
+		stamp := old
+		if fi, err := os.Stat(pth); err != nil {
+			stamp = fileStamp{}
+		} else if !old.exists || !fi.ModTime().Equal(old.modTime) || fi.Size() != old.size {
+			buf, err := ioutil.ReadFile(pth)
+			if err != nil {
+				stamp = fileStamp{}
+			} else {
+				stamp = fileStamp{exists: true, modTime: fi.ModTime(), size: fi.Size(), hash: sha1.Sum(buf)}
+			}
+		}
+		stamps[service] = stamp
+		if !known || stamp.exists != old.exists || stamp.hash != old.hash {
+			w.refreshService(ctx, service)
+		}
+	}
+	for service := range stamps {
+		if _, ok := watched[service]; !ok {
+			delete(stamps, service)
+		}
+	}
+}
+
+// refreshService looks up the given service and sends an update if it changed.
+// Ignores the services not watched.
+func (w *Watcher) refreshService(ctx context.Context, service string) {
+	endpoints, err := LookupLocalService(service, w.dir)
+	var addr, key, errStr string
+	if err != nil {
+		errStr = err.Error()
+	} else {
+		addr, key = endpoints[0].String(), endpointsKey(endpoints)
+	}
+
+	w.mu.Lock()
+	state, ok := w.services[service]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	// Keep the last valid endpoints when the file is invalid.
+	if err != nil && !IsMissingService(err) {
+		addr, endpoints, key = state.addr, state.endpoints, state.key
+	}
+	if state.resolved && state.key == key && state.err == errStr {
+		w.mu.Unlock()
+		return
+	}
+	u := Update{Service: service, Old: state.addr, New: addr, Err: err, Endpoints: endpoints}
+	state.resolved, state.addr, state.endpoints, state.key, state.err = true, addr, endpoints, key, errStr
+	w.mu.Unlock()
+
+	w.send(ctx, u)
+}
+
+// endpointsKey returns a string identifying the given endpoints.
+func endpointsKey(endpoints []Endpoint) string {
+	buf, _ := json.Marshal(endpoints) // Can't fail.
+	return string(buf)
+}
+
+// send sends the update unless the context is done.
+func (w *Watcher) send(ctx context.Context, u Update) {
+	select {
+	case w.updates <- u:
+	case <-ctx.Done():
+	}
+}
+
+// openFSWatcher creates a fsnotify watcher on the given directory.
+// Overridden by the tests.
+var openFSWatcher = func(dir string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, &WatchError{Path: dir, Err: err}
+	}
+	if err := watcher.Add(dir); err != nil {
+		_ = watcher.Close() // Best effort.
+		return nil, &WatchError{Path: dir, Err: err}
+	}
+	return watcher, nil
+}
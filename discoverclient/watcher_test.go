@@ -0,0 +1,311 @@
+package discoverclient
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+// startWatcher creates a temp discovery directory and starts a Watcher on the given services.
+// The cleanup function stops the watcher and removes the directory.
+func startWatcher(t *testing.T, services ...string) (string, *Watcher, func()) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher(dir, services...)
+	w.Interval = time.Hour // Make sure the updates come from the events.
+	w.Debounce = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = w.Run(ctx) }()
+	return dir, w, func() {
+		cancel()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// expectUpdate waits for the next service update and checks its values.
+// Watch errors are skipped.
+func expectUpdate(t *testing.T, w *Watcher, service, oldAddr, newAddr string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case u := <-w.Updates():
+			if u.Service == "" {
+				continue
+			}
+			if u.Service != service || u.Old != oldAddr || u.New != newAddr {
+				t.Fatalf("Unexpected update.\nExpected: {%s %q -> %q}\nGot:      {%s %q -> %q} (%v)", service, oldAddr, newAddr, u.Service, u.Old, u.New, u.Err)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("Timeout waiting for %s update %q -> %q", service, oldAddr, newAddr)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherRenameIntoPlace(t *testing.T) {
+	dir, w, cleanup := startWatcher(t, "db")
+	defer cleanup()
+
+	expectUpdate(t, w, "db", "", "") // Initially missing.
+
+	tmp := filepath.Join(dir, ".db.tmp")
+	writeFile(t, tmp, "10.0.0.2:5432")
+	if err := os.Rename(tmp, filepath.Join(dir, "db")); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, w, "db", "", "10.0.0.2:5432")
+
+	writeFile(t, tmp, "10.0.0.3:5432")
+	if err := os.Rename(tmp, filepath.Join(dir, "db")); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, w, "db", "10.0.0.2:5432", "10.0.0.3:5432")
+
+	if ip, err := LookupLocalServiceIP("db", dir); err != nil {
+		t.Fatal(err)
+	} else if expect := "10.0.0.3:5432"; ip != expect {
+		t.Fatalf("Unexpected ip.\nExpected: %s\nGot:      %s", expect, ip)
+	}
+}
+
+func TestWatcherSymlinkSwap(t *testing.T) {
+	dir, w, cleanup := startWatcher(t, "db")
+	defer cleanup()
+
+	expectUpdate(t, w, "db", "", "") // Initially missing.
+
+	// Kubernetes ConfigMap layout: db -> ..data/db, ..data -> ..v1.
+	v1, v2 := filepath.Join(dir, "..v1"), filepath.Join(dir, "..v2")
+	for _, d := range []string{v1, v2} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(v1, "db"), "10.0.0.2")
+	writeFile(t, filepath.Join(v2, "db"), "[fd00::2]:5432")
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "db"), filepath.Join(dir, "db")); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, w, "db", "", "10.0.0.2")
+
+	// Atomic swap of the ..data symlink.
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, w, "db", "10.0.0.2", "[fd00::2]:5432")
+}
+
+func TestWatcherDirectoryRecreated(t *testing.T) {
+	dir, w, cleanup := startWatcher(t, "db")
+	defer cleanup()
+
+	expectUpdate(t, w, "db", "", "") // Initially missing.
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.2")
+	expectUpdate(t, w, "db", "", "10.0.0.2")
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, w, "db", "10.0.0.2", "")
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.3")
+	expectUpdate(t, w, "db", "", "10.0.0.3")
+}
+
+func TestWatcherPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	w := NewWatcher(dir, "db")
+	w.Interval = time.Hour // Make sure the updates come from the polling.
+	w.Mode = WatchPoll
+	w.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = w.Run(ctx) }()
+
+	expectUpdate(t, w, "db", "", "") // Initially missing.
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.2")
+	expectUpdate(t, w, "db", "", "10.0.0.2")
+
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.3")
+	expectUpdate(t, w, "db", "10.0.0.2", "10.0.0.3")
+
+	if err := os.Remove(filepath.Join(dir, "db")); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, w, "db", "10.0.0.3", "")
+}
+
+func TestWatcherPollFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	missing := filepath.Join(dir, "missing")
+
+	// The directory does not exist: watcher.Add fails, the watcher falls back on polling.
+	w := NewWatcher(missing, "db")
+	w.Interval = time.Hour
+	w.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = w.Run(ctx) }()
+
+	select {
+	case u := <-w.Updates():
+		if _, ok := u.Err.(*WatchError); !ok || u.Service != "" {
+			t.Fatalf("Expected a watch error, got: %+v", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the watch error")
+	}
+	expectUpdate(t, w, "db", "", "")
+}
+
+func TestWatcherHybrid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	w := NewWatcher(dir, "db")
+	w.Interval = time.Hour // Make sure the updates come from the events or the polling.
+	w.Debounce = 10 * time.Millisecond
+	w.Mode = WatchHybrid
+	w.PollInterval = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = w.Run(ctx) }()
+
+	expectUpdate(t, w, "db", "", "") // Initially missing.
+
+	// Changes in the discovery directory are caught by inotify, well before the next poll.
+	start := time.Now()
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.2")
+	expectUpdate(t, w, "db", "", "10.0.0.2")
+	if elapsed := time.Since(start); elapsed >= w.PollInterval/2 {
+		t.Fatalf("Update not triggered by inotify, took %s", elapsed)
+	}
+
+	// Writes to a symlink target outside of the discovery directory yield no inotify event,
+	// they are caught by the polling.
+	w.Add("cache")
+	expectUpdate(t, w, "cache", "", "")
+	target := filepath.Join(dir, "data", "cache")
+	if err := os.Mkdir(filepath.Dir(target), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, target, "10.0.0.3")
+	if err := os.Symlink(target, filepath.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, w, "cache", "", "10.0.0.3")
+	writeFile(t, target, "10.0.0.4:6379")
+	expectUpdate(t, w, "cache", "10.0.0.3", "10.0.0.4:6379")
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	w := NewWatcher(dir, "db")
+	w.Interval = time.Hour // Make sure the updates come from the events.
+	w.Debounce = 300 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = w.Run(ctx) }()
+
+	expectUpdate(t, w, "db", "", "") // Initially missing.
+	// A burst of writes within the debounce window yields a single update with the final value.
+	for i := 2; i < 12; i++ {
+		writeFile(t, filepath.Join(dir, "db"), "10.0.0."+strconv.Itoa(i)+":5432")
+		time.Sleep(5 * time.Millisecond)
+	}
+	expectUpdate(t, w, "db", "", "10.0.0.11:5432")
+	select {
+	case u := <-w.Updates():
+		t.Fatalf("Unexpected update after the burst: %+v", u)
+	case <-time.After(2 * w.Debounce):
+	}
+}
+
+func TestWatcherClosed(t *testing.T) {
+	watchers := make(chan *fsnotify.Watcher, 10)
+	defer func(open func(string) (*fsnotify.Watcher, error)) { openFSWatcher = open }(openFSWatcher)
+	openFSWatcher = func(dir string) (*fsnotify.Watcher, error) {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close() // Best effort.
+			return nil, err
+		}
+		watchers <- watcher
+		return watcher, nil
+	}
+
+	dir, w, cleanup := startWatcher(t, "db")
+	defer cleanup()
+	nextWatcher := func() *fsnotify.Watcher {
+		select {
+		case watcher := <-watchers:
+			return watcher
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for the inotify watcher")
+		}
+		return nil
+	}
+
+	expectUpdate(t, w, "db", "", "") // Initially missing.
+	// The inotify watcher dies: the error is reported and the services are still watched.
+	if err := nextWatcher().Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u := <-w.Updates():
+		if err, ok := u.Err.(*WatchError); !ok || err.Err != errWatcherClosed || u.Service != "" {
+			t.Fatalf("Expected a watch error, got: %+v", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the watch error")
+	}
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.2")
+	expectUpdate(t, w, "db", "", "10.0.0.2")
+
+	// The inotify watcher is recreated.
+	_ = nextWatcher()
+	writeFile(t, filepath.Join(dir, "db"), "10.0.0.3")
+	expectUpdate(t, w, "db", "10.0.0.2", "10.0.0.3")
+}
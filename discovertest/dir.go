@@ -0,0 +1,67 @@
+package discovertest
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+)
+
+// Dir is a temp discovery directory.
+// The changes are applied to the real files so the watchers get the fsnotify events.
+type Dir struct {
+	Path string
+}
+
+// NewDir creates a new empty discovery directory. The caller should call Close when finished.
+func NewDir() (*Dir, error) {
+	path, err := ioutil.TempDir("", "discovertest")
+	if err != nil {
+		return nil, err
+	}
+	return &Dir{Path: path}, nil
+}
+
+// Close removes the directory.
+func (d *Dir) Close() error {
+	return os.RemoveAll(d.Path)
+}
+
+// Add registers the given addresses to the service, creating it if needed.
+// See discoverclient.ParseEndpoint for the address format.
+func (d *Dir) Add(service string, addrs ...string) error {
+	endpoints, err := parseEndpoints(addrs)
+	if err != nil {
+		return err
+	}
+	return discoverclient.RegisterLocalService(service, d.Path, endpoints...)
+}
+
+// Update replaces the addresses of the service, creating it if needed.
+// The file is renamed into place so the watchers never see it missing nor partial.
+// See discoverclient.ReplaceLocalService.
+func (d *Dir) Update(service string, addrs ...string) error {
+	endpoints, err := parseEndpoints(addrs)
+	if err != nil {
+		return err
+	}
+	return discoverclient.ReplaceLocalService(service, d.Path, endpoints...)
+}
+
+// Remove removes the service. Not an error if the service is not present.
+func (d *Dir) Remove(service string) error {
+	return discoverclient.DeregisterLocalService(service, d.Path)
+}
+
+// parseEndpoints parses the given addresses.
+func parseEndpoints(addrs []string) ([]discoverclient.Endpoint, error) {
+	endpoints := make([]discoverclient.Endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		endpoint, err := discoverclient.ParseEndpoint(addr)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
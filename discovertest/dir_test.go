@@ -0,0 +1,66 @@
+package discovertest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+)
+
+func TestDirWatch(t *testing.T) {
+	dir, err := NewDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dir.Close() }()
+
+	events := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = discoverclient.WatchServiceHooks(ctx, "db", dir.Path, discoverclient.WatchHooks{
+			OnAdd:    func(addr string) { events <- "add " + addr },
+			OnChange: func(oldAddr, newAddr string) { events <- "change " + oldAddr + " " + newAddr },
+			OnRemove: func(oldAddr string) { events <- "remove " + oldAddr },
+		})
+	}()
+	expectEvent := func(expect string) {
+		select {
+		case event := <-events:
+			if event != expect {
+				t.Fatalf("Unexpected event.\nExpected: %s\nGot:      %s", expect, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for %s", expect)
+		}
+	}
+
+	if err := dir.Add("db", "10.0.0.2:5432"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("add 10.0.0.2:5432")
+	if err := dir.Update("db", "[fd00::2]:5432", "10.0.0.3:5432"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("change 10.0.0.2:5432 [fd00::2]:5432")
+	if endpoints, err := discoverclient.LookupLocalService("db", dir.Path); err != nil || len(endpoints) != 2 {
+		t.Fatalf("Unexpected endpoints: %v (%v)", endpoints, err)
+	}
+	if err := dir.Remove("db"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("remove [fd00::2]:5432")
+
+	for _, service := range []string{"", ".db", "../db"} {
+		if err := dir.Update(service, "10.0.0.2"); err == nil {
+			t.Fatalf("Expected error for service %q", service)
+		}
+	}
+	if err := dir.Update("db"); err == nil {
+		t.Fatal("Expected error without address")
+	}
+	if err := dir.Add("db", "10.0.0.2:0"); err == nil {
+		t.Fatal("Expected error for an invalid address")
+	}
+}
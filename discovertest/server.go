@@ -0,0 +1,205 @@
+// Package discovertest provides a fake discover service and a temp discovery directory
+// for the unit tests of the discoverclient users.
+package discovertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery"
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+)
+
+// SelfID is the ID of the container matched by the requests sent from the local host.
+const SelfID = "discovertest"
+
+// Fault alters the handling of a request.
+type Fault struct {
+	Latency time.Duration // Delay before handling the request, cut short when the client gives up.
+	Status  int           // 5xx status sent instead of the response. 0 to serve the request.
+	Drop    bool          // Close the connection without response.
+}
+
+// Server is an in-process discover service.
+// The requests sent from the local host match a container whose ports are set with SetPort.
+// Other containers can be added to the Backend, see localdiscovery.MemoryBackend.
+type Server struct {
+	URL     string // Address of the service. ex: http://127.0.0.1:44321
+	Backend *localdiscovery.MemoryBackend
+
+	server  *httptest.Server
+	handler http.Handler
+
+	mu       sync.Mutex
+	self     localdiscovery.StaticContainer
+	faults   []Fault // Faults of the next requests, in order.
+	fault    Fault   // Fault of the requests once faults is empty.
+	requests int
+}
+
+// NewServer starts a new Server without port. The caller should call Close when finished.
+func NewServer() *Server {
+	hostname, _ := os.Hostname() // Best effort, the requests are matched by remote IP.
+	s := &Server{
+		Backend: localdiscovery.NewMemoryBackend(),
+		self: localdiscovery.StaticContainer{
+			ID:       SelfID,
+			Name:     SelfID,
+			Hostname: hostname,
+			Networks: map[string]string{"loopback": "127.0.0.1", "loopback6": "::1"},
+			Ports:    map[string][]string{},
+		},
+	}
+	if err := s.Backend.Set(s.self); err != nil {
+		panic(err) // The initial container is valid.
+	}
+	s.handler = localdiscovery.NewRouter(s.Backend)
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts down the server and blocks until all the requests are done.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Client returns a client of the server retrying without delay.
+func (s *Server) Client() *discoverclient.Client {
+	client := discoverclient.NewClient(s.URL)
+	client.MinBackoff = time.Millisecond
+	client.MaxBackoff = time.Millisecond
+	return client
+}
+
+// SetPort publishes the given container port on the given host bindings. ex: SetPort("80", "32768").
+// The port may omit the protocol, tcp is assumed.
+// A binding is a host port optionally prefixed by the host IP. ex: 8080, 127.0.0.1:8080.
+// Without binding, the port is exposed but not published.
+func (s *Server) SetPort(port string, bindings ...string) error {
+	return s.update(func(self *localdiscovery.StaticContainer) {
+		self.Ports[portKey(port)] = append([]string{}, bindings...)
+	})
+}
+
+// RemovePort removes the given container port. The lookups fail with ErrNotExposed.
+func (s *Server) RemovePort(port string) error {
+	return s.update(func(self *localdiscovery.StaticContainer) {
+		delete(self.Ports, portKey(port))
+	})
+}
+
+// SetHealth sets the health status of the container.
+func (s *Server) SetHealth(health discoverclient.HealthStatus) error {
+	return s.update(func(self *localdiscovery.StaticContainer) {
+		self.Health = health
+	})
+}
+
+// update applies the given change to a copy of the container and sets it.
+// The container is kept as is if the change is invalid.
+func (s *Server) update(change func(*localdiscovery.StaticContainer)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	self := s.self
+	self.Ports = make(map[string][]string, len(s.self.Ports))
+	for port, bindings := range s.self.Ports {
+		self.Ports[port] = bindings
+	}
+	change(&self)
+	if err := s.Backend.Set(self); err != nil {
+		return err
+	}
+	s.self = self
+	return nil
+}
+
+// InjectFaults queues faults for the next requests, one per request.
+func (s *Server) InjectFaults(faults ...Fault) {
+	s.mu.Lock()
+	s.faults = append(s.faults, faults...)
+	s.mu.Unlock()
+}
+
+// SetFault sets the fault of all the requests once the queued faults are consumed.
+// Fault{} serves the requests normally.
+func (s *Server) SetFault(fault Fault) {
+	s.mu.Lock()
+	s.fault = fault
+	s.mu.Unlock()
+}
+
+// ClearFaults drops the queued faults and serves the requests normally.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	s.faults, s.fault = nil, Fault{}
+	s.mu.Unlock()
+}
+
+// Requests returns the number of requests received, including the faulted ones.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// nextFault counts the request and returns its fault.
+func (s *Server) nextFault() Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if len(s.faults) == 0 {
+		return s.fault
+	}
+	fault := s.faults[0]
+	s.faults = s.faults[1:]
+	return fault
+}
+
+// serveHTTP applies the fault of the request before serving it.
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	fault := s.nextFault()
+	if fault.Latency > 0 {
+		timer := time.NewTimer(fault.Latency)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+	if fault.Drop {
+		// The plain http test server always supports hijacking.
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			_ = conn.Close() // Best effort.
+		}
+		return
+	}
+	if fault.Status != 0 {
+		code := discoverclient.CodeInternal
+		if fault.Status == http.StatusServiceUnavailable {
+			code = discoverclient.CodeBackendUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(fault.Status)
+		_ = json.NewEncoder(w).Encode(discoverclient.ErrorResponse{Error: &discoverclient.APIError{ // Best effort.
+			Code:    code,
+			Message: "discovertest: injected fault",
+		}})
+		return
+	}
+	s.handler.ServeHTTP(w, req)
+}
+
+// portKey defaults the given port to tcp.
+func portKey(port string) string {
+	if !strings.Contains(port, "/") {
+		return port + "/tcp"
+	}
+	return port
+}
@@ -0,0 +1,102 @@
+package discovertest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+)
+
+func TestServerPorts(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	if err := s.SetPort("80", "32768", "127.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPort("53/udp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPort("81", "nope"); err == nil {
+		t.Fatal("Expected error for an invalid binding")
+	}
+
+	if port, err := discoverclient.SelfDockerLookup(s.URL, "", "80/tcp"); err != nil || port != 32768 {
+		t.Fatalf("Unexpected port: %d (%v)", port, err)
+	}
+	resp, err := discoverclient.SelfDockerLookupBindings(s.URL, "", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Container != SelfID || len(resp.Bindings) != 2 || resp.Bindings[1].HostIP != "127.0.0.1" || resp.Bindings[1].HostPort != 8080 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if _, err := s.Client().LookupPort(context.Background(), "", "53/udp"); err != discoverclient.ErrNotPublished {
+		t.Fatalf("Unexpected error for an unpublished port: %v", err)
+	}
+	if _, err := s.Client().LookupPort(context.Background(), "", "81"); err != discoverclient.ErrNotExposed {
+		t.Fatalf("Unexpected error for an invalid port: %v", err)
+	}
+	// The legacy lookup reports 0 for both.
+	for _, port := range []string{"53/udp", "81"} {
+		if port, err := discoverclient.SelfDockerLookup(s.URL, "", port); err != nil || port != 0 {
+			t.Fatalf("Unexpected legacy port: %d (%v)", port, err)
+		}
+	}
+	if err := s.RemovePort("80/tcp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Client().LookupPort(context.Background(), "", "80"); err != discoverclient.ErrNotExposed {
+		t.Fatalf("Unexpected error for a removed port: %v", err)
+	}
+
+	if err := s.SetHealth(discoverclient.HealthStarting); err != nil {
+		t.Fatal(err)
+	}
+	client := s.Client()
+	client.RequireHealth = discoverclient.HealthFail
+	if _, err := client.LookupBindings(context.Background(), "", "53/udp"); err != discoverclient.ErrContainerUnhealthy {
+		t.Fatalf("Unexpected error for an unhealthy container: %v", err)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	if err := s.SetPort("80", "32768"); err != nil {
+		t.Fatal(err)
+	}
+	client := s.Client()
+	client.MaxRetries = 2
+
+	// The client retries the 5xx and the dropped connections.
+	s.InjectFaults(Fault{Status: http.StatusServiceUnavailable}, Fault{Drop: true})
+	if port, err := client.LookupPort(context.Background(), "", "80"); err != nil || port != 32768 {
+		t.Fatalf("Unexpected port: %d (%v)", port, err)
+	}
+	if expect, got := 3, s.Requests(); got != expect {
+		t.Fatalf("Unexpected request count.\nExpected: %d\nGot:      %d", expect, got)
+	}
+
+	s.SetFault(Fault{Status: http.StatusServiceUnavailable})
+	if _, err := client.LookupPort(context.Background(), "", "80"); err != discoverclient.ErrBackendUnavailable {
+		t.Fatalf("Unexpected error for a failing service: %v", err)
+	}
+	if expect, got := 6, s.Requests(); got != expect {
+		t.Fatalf("Unexpected request count.\nExpected: %d\nGot:      %d", expect, got)
+	}
+
+	s.SetFault(Fault{Latency: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.LookupPort(ctx, "", "80"); err == nil {
+		t.Fatal("Expected error for a slow service")
+	}
+
+	s.ClearFaults()
+	if err := client.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
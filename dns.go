@@ -0,0 +1,593 @@
+package localdiscovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DefaultDNSDomain is the default zone served by the DNSServer.
+const DefaultDNSDomain = "local.discover."
+
+// composeServiceLabel is the label docker-compose sets to the service name,
+// which is also the network alias of the container.
+const composeServiceLabel = "com.docker.compose.service"
+
+const (
+	dnsFileTTL    = 5 * time.Second  // TTL of the records from the discovery files.
+	dnsTCPTimeout = 10 * time.Second // Idle timeout of the TCP connections.
+	dnsMaxUDPSize = 512              // Maximum size of the UDP messages, EDNS is not supported.
+	dnsHeaderLen  = 12
+)
+
+// DNS record types and classes.
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+	dnsClassANY = 255
+)
+
+// DNS response codes.
+const (
+	dnsRcodeSuccess  = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+)
+
+// DNS header flags.
+const (
+	dnsFlagQR     = 1 << 15
+	dnsFlagAA     = 1 << 10
+	dnsFlagTC     = 1 << 9
+	dnsFlagRD     = 1 << 8
+	dnsOpcodeMask = 0xF << 11
+)
+
+// errDNSFormat is returned when a DNS message can't be parsed.
+var errDNSFormat = errors.New("malformed DNS message")
+
+// DNSServer is a small authoritative DNS responder for the DNS domain, local.discover. by default:
+// - <service>.local.discover. A/AAAA from the discovery files and the docker container names,
+// hostnames and compose service names.
+// - _<port>._<proto>.<service>.local.discover. SRV from the published host ports of the containers
+// and the discovery file endpoints with a port.
+// - <ip>.ip.local.discover. A/AAAA, the SRV targets. ex: 10-0-0-1.ip.local.discover.
+// Docker records TTL is the time left until the next cache reconciliation.
+// Names are case insensitive, the discovery files included.
+type DNSServer struct {
+	// Domain is the served zone. Defaults to DefaultDNSDomain.
+	// Must be set before serving.
+	Domain string
+	// ExcludeUnhealthy skips the containers with a healthcheck which are not healthy yet or anymore.
+	// Must be set before serving.
+	ExcludeUnhealthy bool
+
+	discovery     *DockerDiscovery
+	discoveryPath string
+}
+
+// NewDNSServer instantiates a new DNSServer answering from the given discovery
+// and discovery directory. An empty discoveryPath disables the discovery files lookup.
+func NewDNSServer(discovery *DockerDiscovery, discoveryPath string) *DNSServer {
+	return &DNSServer{
+		Domain:        DefaultDNSDomain,
+		discovery:     discovery,
+		discoveryPath: discoveryPath,
+	}
+}
+
+// ListenAndServe serves the DNS queries on the given address over UDP and TCP.
+// Blocks until one of the listeners fails.
+func (s *DNSServer) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }() // Best effort.
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = l.Close() }() // Best effort.
+
+	errChan := make(chan error, 2)
+	go func() { errChan <- s.ServeUDP(conn) }()
+	go func() { errChan <- s.ServeTCP(l) }()
+	return <-errChan
+}
+
+// ServeUDP serves the DNS queries received on the given connection.
+// Blocks until the connection fails.
+func (s *DNSServer) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		resp := s.handle(buf[:n], dnsMaxUDPSize)
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			logrus.WithError(err).WithField("client", addr).Error("error sending DNS response")
+		}
+	}
+}
+
+// ServeTCP serves the DNS queries received on the given listener.
+// Blocks until the listener fails.
+func (s *DNSServer) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn serves the length prefixed DNS queries of the given connection until it is closed or idle.
+func (s *DNSServer) serveTCPConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }() // Best effort.
+	for {
+		_ = conn.SetDeadline(time.Now().Add(dnsTCPTimeout)) // Best effort.
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := s.handle(query, 65535)
+		if resp == nil {
+			return
+		}
+		msg := make([]byte, 2, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		if _, err := conn.Write(append(msg, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// dnsQuestion is the question of a DNS query.
+type dnsQuestion struct {
+	name   string // Lower case, fully qualified.
+	qtype  uint16
+	qclass uint16
+}
+
+// dnsRecord is a resource record of a DNS response.
+type dnsRecord struct {
+	name  string // Empty for the question name.
+	rtype uint16
+	ttl   time.Duration
+	data  []byte
+}
+
+// handle answers the given DNS query. Returns nil if the query should be dropped.
+// The response is truncated when larger than maxSize.
+func (s *DNSServer) handle(query []byte, maxSize int) []byte {
+	if len(query) < dnsHeaderLen {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(query[0:2])
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&dnsFlagQR != 0 {
+		return nil // Not a query.
+	}
+	flags = dnsFlagQR | dnsFlagAA | flags&(dnsOpcodeMask|dnsFlagRD)
+	if flags&dnsOpcodeMask != 0 {
+		return dnsResponse(id, flags|dnsRcodeNotImp, nil, nil, nil)
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return dnsResponse(id, flags|dnsRcodeFormErr, nil, nil, nil)
+	}
+	q, end, err := parseQuestion(query, dnsHeaderLen)
+	if err != nil {
+		return dnsResponse(id, flags|dnsRcodeFormErr, nil, nil, nil)
+	}
+	rawQuestion := query[dnsHeaderLen:end]
+	if q.qclass != dnsClassIN && q.qclass != dnsClassANY {
+		return dnsResponse(id, flags|dnsRcodeRefused, rawQuestion, nil, nil)
+	}
+
+	answers, extra, rcode := s.resolve(q)
+	resp := dnsResponse(id, flags|uint16(rcode), rawQuestion, answers, extra)
+	if len(resp) > maxSize {
+		resp = dnsResponse(id, flags|dnsFlagTC|uint16(rcode), rawQuestion, nil, nil)
+	}
+	return resp
+}
+
+// resolve answers the given question. Returns the answers, the additional records and the response code.
+func (s *DNSServer) resolve(q *dnsQuestion) ([]dnsRecord, []dnsRecord, int) {
+	domain := dnsFQDN(s.Domain)
+	if domain == "." {
+		domain = DefaultDNSDomain
+	}
+	if q.name == domain {
+		return nil, nil, dnsRcodeSuccess
+	}
+	if !strings.HasSuffix(q.name, "."+domain) {
+		return nil, nil, dnsRcodeRefused
+	}
+	labels := strings.Split(strings.TrimSuffix(q.name, "."+domain), ".")
+
+	switch {
+	case len(labels) == 2 && labels[1] == "ip":
+		ip := dnsDecodeIP(labels[0])
+		if ip == nil {
+			return nil, nil, dnsRcodeNXDomain
+		}
+		return addressRecords("", []net.IP{ip}, dnsFileTTL, q.qtype), nil, dnsRcodeSuccess
+	case len(labels) == 3 && strings.HasPrefix(labels[0], "_") && (labels[1] == "_tcp" || labels[1] == "_udp"):
+		return s.resolveSRV(q, labels[2], labels[0][1:], labels[1][1:], domain)
+	case len(labels) == 1:
+		ips, ttl, found := s.lookupHost(labels[0])
+		if !found {
+			return nil, nil, dnsRcodeNXDomain
+		}
+		return addressRecords("", ips, ttl, q.qtype), nil, dnsRcodeSuccess
+	}
+	return nil, nil, dnsRcodeNXDomain
+}
+
+// resolveSRV answers the SRV question for the given service port.
+func (s *DNSServer) resolveSRV(q *dnsQuestion, service, port, proto, domain string) ([]dnsRecord, []dnsRecord, int) {
+	port, err := normalizePort(port + "/" + proto)
+	if err != nil {
+		return nil, nil, dnsRcodeNXDomain
+	}
+	targets, ttl, found := s.lookupSRV(service, port)
+	if !found {
+		return nil, nil, dnsRcodeNXDomain
+	}
+	if q.qtype != dnsTypeSRV && q.qtype != dnsTypeANY {
+		return nil, nil, dnsRcodeSuccess
+	}
+	var answers, extra []dnsRecord
+	for _, target := range targets {
+		name := dnsEncodeIP(target.ip) + ".ip." + domain
+		data := make([]byte, 6)
+		binary.BigEndian.PutUint16(data[0:2], 0) // Priority.
+		binary.BigEndian.PutUint16(data[2:4], uint16(target.weight))
+		binary.BigEndian.PutUint16(data[4:6], uint16(target.port))
+		answers = append(answers, dnsRecord{rtype: dnsTypeSRV, ttl: ttl, data: appendDNSName(data, name)})
+		extra = append(extra, addressRecords(name, []net.IP{target.ip}, ttl, dnsTypeANY)...)
+	}
+	return answers, extra, dnsRcodeSuccess
+}
+
+// cacheTTL returns the time left until the next container cache reconciliation.
+func (s *DNSServer) cacheTTL() time.Duration {
+	ttl := DefaultReconcileInterval - time.Since(s.discovery.cache.lastUpdate())
+	if ttl < time.Second {
+		return time.Second
+	}
+	if ttl > DefaultReconcileInterval {
+		return DefaultReconcileInterval
+	}
+	return ttl
+}
+
+// lookupEndpoints returns the healthy endpoints of the given service discovery file
+// along with the time left until the first expiry, capped to dnsFileTTL.
+func (s *DNSServer) lookupEndpoints(service string) ([]discoverclient.Endpoint, time.Duration) {
+	if s.discoveryPath == "" {
+		return nil, dnsFileTTL
+	}
+	endpoints, err := discoverclient.LookupLocalService(service, s.discoveryPath)
+	if discoverclient.IsMissingService(err) {
+		// The DNS names are case insensitive, the file names are not.
+		if name, ok := s.serviceFile(service); ok {
+			endpoints, err = discoverclient.LookupLocalService(name, s.discoveryPath)
+		}
+	}
+	if err != nil {
+		if !discoverclient.IsMissingService(err) {
+			logrus.WithError(err).WithField("service", service).Warn("error looking up discovery file")
+		}
+		return nil, dnsFileTTL
+	}
+	ttl := dnsFileTTL
+	for _, endpoint := range endpoints {
+		if endpoint.Expires == nil {
+			continue
+		}
+		if left := endpoint.Expires.Sub(time.Now()); left < ttl {
+			ttl = left
+		}
+	}
+	return endpoints, ttl
+}
+
+// serviceFile returns the name of the discovery file matching the given lower case service
+// regardless of the case. The first one in lexical order if there are several.
+func (s *DNSServer) serviceFile(service string) (string, bool) {
+	files, err := ioutil.ReadDir(s.discoveryPath)
+	if err != nil {
+		return "", false
+	}
+	for _, fi := range files {
+		if name := fi.Name(); name != service && !strings.HasPrefix(name, ".") && strings.EqualFold(name, service) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// lookupContainers returns the running containers matching the given name.
+func (s *DNSServer) lookupContainers(name string) []*docker.Container {
+	var conts []*docker.Container
+	for _, cont := range s.discovery.cache.list() {
+		if s.ExcludeUnhealthy && !isHealthy(containerHealth(cont)) {
+			continue
+		}
+		for _, elem := range containerNames(cont) {
+			if elem == name {
+				conts = append(conts, cont)
+				break
+			}
+		}
+	}
+	return conts
+}
+
+// lookupHost returns the IPs of the given service from the discovery files and the docker containers.
+// Returns false if the service is unknown.
+func (s *DNSServer) lookupHost(service string) ([]net.IP, time.Duration, bool) {
+	var ips []net.IP
+	seen := map[string]struct{}{}
+	add := func(addr string) {
+		ip := net.ParseIP(addr)
+		if _, ok := seen[addr]; ok || ip == nil {
+			return
+		}
+		seen[addr] = struct{}{}
+		ips = append(ips, ip)
+	}
+
+	endpoints, ttl := s.lookupEndpoints(service)
+	for _, endpoint := range endpoints {
+		add(normalizeIP(endpoint.Address))
+	}
+	conts := s.lookupContainers(service)
+	for _, cont := range conts {
+		for _, addr := range containerIPs(cont) {
+			add(addr.IP)
+		}
+	}
+	if len(conts) > 0 {
+		if cacheTTL := s.cacheTTL(); cacheTTL < ttl || len(endpoints) == 0 {
+			ttl = cacheTTL
+		}
+	}
+	return ips, ttl, len(endpoints) > 0 || len(conts) > 0
+}
+
+// srvTarget is a target of a SRV record.
+type srvTarget struct {
+	ip     net.IP
+	port   int
+	weight int
+}
+
+// lookupSRV returns the targets of the given service port, with the protocol suffix.
+// Returns false if the service is unknown.
+func (s *DNSServer) lookupSRV(service, port string) ([]srvTarget, time.Duration, bool) {
+	var targets []srvTarget
+	seen := map[string]struct{}{}
+	add := func(ip string, port, weight int) {
+		parsed := net.ParseIP(ip)
+		key := net.JoinHostPort(ip, strconv.Itoa(port))
+		if _, ok := seen[key]; ok || parsed == nil || port <= 0 || port > 65535 {
+			return
+		}
+		seen[key] = struct{}{}
+		if weight <= 0 {
+			weight = 1
+		}
+		targets = append(targets, srvTarget{ip: parsed, port: port, weight: weight})
+	}
+
+	p := docker.Port(port)
+	endpoints, ttl := s.lookupEndpoints(service)
+	for _, endpoint := range endpoints {
+		if strconv.Itoa(endpoint.Port) == p.Port() && (endpoint.Protocol == "" || endpoint.Protocol == p.Proto()) {
+			add(normalizeIP(endpoint.Address), endpoint.Port, endpoint.Weight)
+		}
+	}
+	conts := s.lookupContainers(service)
+	for _, cont := range conts {
+		resp, err := s.discovery.cache.portResponse(cont, "", port)
+		if err != nil {
+			continue
+		}
+		for _, binding := range resp.Bindings {
+			hostIP := binding.HostIP
+			if ip := net.ParseIP(hostIP); ip == nil || ip.IsUnspecified() {
+				// Published on all the interfaces, reachable via the container gateway.
+				hostIP = containerGateway(cont)
+			}
+			add(normalizeIP(hostIP), binding.HostPort, 1)
+		}
+	}
+	if len(conts) > 0 {
+		if cacheTTL := s.cacheTTL(); cacheTTL < ttl || len(endpoints) == 0 {
+			ttl = cacheTTL
+		}
+	}
+	return targets, ttl, len(endpoints) > 0 || len(conts) > 0
+}
+
+// containerNames returns the lower case DNS names of the given container:
+// its name, hostname and compose service name.
+func containerNames(cont *docker.Container) []string {
+	names := []string{strings.ToLower(strings.TrimPrefix(cont.Name, "/"))}
+	if cont.Config != nil {
+		if cont.Config.Hostname != "" {
+			names = append(names, strings.ToLower(cont.Config.Hostname))
+		}
+		if service := cont.Config.Labels[composeServiceLabel]; service != "" {
+			names = append(names, strings.ToLower(service))
+		}
+	}
+	return names
+}
+
+// containerGateway returns the gateway of the container, the host address on its network.
+// The default bridge network is preferred, then the first network in lexical order.
+func containerGateway(cont *docker.Container) string {
+	if cont.NetworkSettings == nil {
+		return ""
+	}
+	if network, ok := cont.NetworkSettings.Networks[defaultNetwork]; ok && network.Gateway != "" {
+		return network.Gateway
+	}
+	names := make([]string, 0, len(cont.NetworkSettings.Networks))
+	for name := range cont.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if gateway := cont.NetworkSettings.Networks[name].Gateway; gateway != "" {
+			return gateway
+		}
+	}
+	return cont.NetworkSettings.Gateway
+}
+
+// addressRecords returns the A and/or AAAA records of the given IPs matching the question type.
+func addressRecords(name string, ips []net.IP, ttl time.Duration, qtype uint16) []dnsRecord {
+	var records []dnsRecord
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype == dnsTypeA || qtype == dnsTypeANY {
+				records = append(records, dnsRecord{name: name, rtype: dnsTypeA, ttl: ttl, data: ip4})
+			}
+			continue
+		}
+		if qtype == dnsTypeAAAA || qtype == dnsTypeANY {
+			records = append(records, dnsRecord{name: name, rtype: dnsTypeAAAA, ttl: ttl, data: ip.To16()})
+		}
+	}
+	return records
+}
+
+// dnsEncodeIP encodes the given IP as a DNS label. ex: 10-0-0-1 or fd00--1.
+func dnsEncodeIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.Replace(ip4.String(), ".", "-", -1)
+	}
+	return strings.Replace(ip.String(), ":", "-", -1)
+}
+
+// dnsDecodeIP decodes the IP label encoded by dnsEncodeIP. Returns nil if invalid.
+func dnsDecodeIP(label string) net.IP {
+	if ip := net.ParseIP(strings.Replace(label, "-", ".", -1)); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.Replace(label, "-", ":", -1))
+}
+
+// dnsFQDN returns the lower case, fully qualified form of the given name.
+func dnsFQDN(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// parseQuestion parses the question at the given offset of the message.
+// Returns the question and the offset of its end.
+func parseQuestion(msg []byte, off int) (*dnsQuestion, int, error) {
+	var labels []string
+	for {
+		if off >= len(msg) {
+			return nil, 0, errDNSFormat
+		}
+		length := int(msg[off])
+		off++
+		if length == 0 {
+			break
+		}
+		// Compression is not expected in the question of a query.
+		if length > 63 || off+length > len(msg) {
+			return nil, 0, errDNSFormat
+		}
+		labels = append(labels, string(msg[off:off+length]))
+		off += length
+	}
+	if off+4 > len(msg) {
+		return nil, 0, errDNSFormat
+	}
+	q := &dnsQuestion{
+		name:   dnsFQDN(strings.Join(labels, ".")),
+		qtype:  binary.BigEndian.Uint16(msg[off : off+2]),
+		qclass: binary.BigEndian.Uint16(msg[off+2 : off+4]),
+	}
+	return q, off + 4, nil
+}
+
+// appendDNSName appends the uncompressed wire form of the given name.
+func appendDNSName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+// dnsResponse builds the wire form of a DNS response.
+// The records with an empty name point to the question name.
+func dnsResponse(id, flags uint16, rawQuestion []byte, answers, extra []dnsRecord) []byte {
+	msg := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], flags)
+	if rawQuestion != nil {
+		binary.BigEndian.PutUint16(msg[4:6], 1)
+	}
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:12], uint16(len(extra)))
+	msg = append(msg, rawQuestion...)
+	for _, records := range [][]dnsRecord{answers, extra} {
+		for _, record := range records {
+			if record.name == "" {
+				msg = append(msg, 0xC0, dnsHeaderLen) // Pointer to the question name.
+			} else {
+				msg = appendDNSName(msg, record.name)
+			}
+			ttl := uint32(record.ttl / time.Second)
+			msg = append(msg,
+				byte(record.rtype>>8), byte(record.rtype),
+				0, dnsClassIN,
+				byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl),
+				byte(len(record.data)>>8), byte(len(record.data)),
+			)
+			msg = append(msg, record.data...)
+		}
+	}
+	return msg
+}
@@ -0,0 +1,237 @@
+package localdiscovery
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// dnsQuery builds the wire form of a query for the given name and type.
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], dnsFlagRD)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	msg = appendDNSName(msg, name)
+	return append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+// stubAnswer is a parsed answer record.
+type stubAnswer struct {
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+// parseStubResponse parses the response header and answers.
+// Expects the answer names to be compressed pointers, as sent by the DNSServer.
+func parseStubResponse(t *testing.T, id uint16, msg []byte) (int, []stubAnswer) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg[0:2]) != id {
+		t.Fatalf("Invalid response: %v", msg)
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&dnsFlagQR == 0 || flags&dnsFlagAA == 0 {
+		t.Fatalf("Unexpected response flags: %x", flags)
+	}
+	_, off, err := parseQuestion(msg, dnsHeaderLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answers []stubAnswer
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:8])); i++ {
+		off += 2 // Name pointer.
+		length := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		answers = append(answers, stubAnswer{
+			rtype: binary.BigEndian.Uint16(msg[off : off+2]),
+			ttl:   binary.BigEndian.Uint32(msg[off+4 : off+8]),
+			data:  msg[off+10 : off+10+length],
+		})
+		off += 10 + length
+	}
+	return int(flags & 0xF), answers
+}
+
+func TestDNSServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := ioutil.WriteFile(filepath.Join(dir, "db"), []byte("10.0.0.2:5432\nfd00::2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Cache"), []byte("10.0.0.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	discovery := &DockerDiscovery{cache: newContainerCache()}
+	discovery.cache.replace([]*docker.Container{{
+		ID:     "abc",
+		Name:   "/web",
+		Config: &docker.Config{Hostname: "abc"},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]docker.ContainerNetwork{
+				"bridge": {IPAddress: "172.17.0.2", Gateway: "172.17.0.1"},
+			},
+			Ports: map[docker.Port][]docker.PortBinding{
+				"80/tcp": {{HostIP: "0.0.0.0", HostPort: "32768"}},
+			},
+		},
+	}})
+	server := NewDNSServer(discovery, dir)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	go func() { _ = server.ServeUDP(conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	exchange := func(id uint16, name string, qtype uint16) (int, []stubAnswer) {
+		if _, err := client.Write(dnsQuery(id, name, qtype)); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, dnsMaxUDPSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseStubResponse(t, id, buf[:n])
+	}
+
+	for i, tc := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		expect []string // Addresses or SRV host ports.
+	}{
+		{name: "web.local.discover.", qtype: dnsTypeA, expect: []string{"172.17.0.2"}},
+		{name: "WEB.Local.Discover", qtype: dnsTypeA, expect: []string{"172.17.0.2"}},
+		{name: "web.local.discover.", qtype: dnsTypeAAAA},
+		{name: "db.local.discover.", qtype: dnsTypeA, expect: []string{"10.0.0.2"}},
+		{name: "db.local.discover.", qtype: dnsTypeAAAA, expect: []string{"fd00::2"}},
+		{name: "cache.local.discover.", qtype: dnsTypeA, expect: []string{"10.0.0.3"}},
+		{name: "CACHE.local.discover.", qtype: dnsTypeA, expect: []string{"10.0.0.3"}},
+		{name: "_80._tcp.web.local.discover.", qtype: dnsTypeSRV, expect: []string{"32768"}},
+		{name: "_5432._tcp.db.local.discover.", qtype: dnsTypeSRV, expect: []string{"5432"}},
+		{name: "_81._tcp.web.local.discover.", qtype: dnsTypeSRV},
+		{name: "172-17-0-1.ip.local.discover.", qtype: dnsTypeA, expect: []string{"172.17.0.1"}},
+		{name: "nope.local.discover.", qtype: dnsTypeA, rcode: dnsRcodeNXDomain},
+		{name: "example.com.", qtype: dnsTypeA, rcode: dnsRcodeRefused},
+	} {
+		rcode, answers := exchange(uint16(i+1), tc.name, tc.qtype)
+		if rcode != tc.rcode {
+			t.Fatalf("Unexpected rcode for %s.\nExpected: %d\nGot:      %d", tc.name, tc.rcode, rcode)
+		}
+		if len(answers) != len(tc.expect) {
+			t.Fatalf("Unexpected answer count for %s.\nExpected: %d\nGot:      %d", tc.name, len(tc.expect), len(answers))
+		}
+		for j, answer := range answers {
+			var got string
+			if answer.rtype == dnsTypeSRV {
+				got = strconv.Itoa(int(binary.BigEndian.Uint16(answer.data[4:6])))
+			} else {
+				got = net.IP(answer.data).String()
+			}
+			if got != tc.expect[j] {
+				t.Fatalf("Unexpected answer for %s.\nExpected: %s\nGot:      %s", tc.name, tc.expect[j], got)
+			}
+			if answer.ttl == 0 || answer.ttl > uint32(DefaultReconcileInterval/time.Second) {
+				t.Fatalf("Unexpected TTL for %s: %d", tc.name, answer.ttl)
+			}
+		}
+	}
+}
+
+func TestDNSServerTCP(t *testing.T) {
+	discovery := &DockerDiscovery{cache: newContainerCache()}
+	discovery.cache.replace([]*docker.Container{{
+		ID:              "abc",
+		Name:            "/web",
+		NetworkSettings: &docker.NetworkSettings{IPAddress: "172.17.0.2"},
+	}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	go func() { _ = NewDNSServer(discovery, "").ServeTCP(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	query := dnsQuery(42, "web.local.discover.", dnsTypeA)
+	msg := append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, length)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	rcode, answers := parseStubResponse(t, 42, resp)
+	if rcode != dnsRcodeSuccess || len(answers) != 1 || net.IP(answers[0].data).String() != "172.17.0.2" {
+		t.Fatalf("Unexpected response: %d %v", rcode, answers)
+	}
+}
+
+func TestDNSServerExcludeUnhealthy(t *testing.T) {
+	discovery := &DockerDiscovery{cache: newContainerCache()}
+	var conts []*docker.Container
+	for i, health := range []string{"healthy", "unhealthy", "starting", ""} {
+		cont := fakeContainer(strconv.Itoa(i), "172.17.0."+strconv.Itoa(i+2))
+		cont.Name = "/web-" + strconv.Itoa(i)
+		cont.Config.Labels = map[string]string{composeServiceLabel: "web"}
+		cont.State.Health.Status = health
+		conts = append(conts, cont)
+	}
+	discovery.cache.replace(conts)
+	server := NewDNSServer(discovery, "")
+
+	lookup := func(name string) []string {
+		ips, _, ok := server.lookupHost(name)
+		if !ok {
+			return nil
+		}
+		var addrs []string
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		return addrs
+	}
+	if addrs := lookup("web"); !reflect.DeepEqual(addrs, []string{"172.17.0.2", "172.17.0.3", "172.17.0.4", "172.17.0.5"}) {
+		t.Fatalf("Unexpected addresses: %v", addrs)
+	}
+
+	server.ExcludeUnhealthy = true
+	if addrs := lookup("web"); !reflect.DeepEqual(addrs, []string{"172.17.0.2", "172.17.0.5"}) {
+		t.Fatalf("Unexpected addresses without the unhealthy containers: %v", addrs)
+	}
+	// The names of the unhealthy containers are unknown.
+	if addrs := lookup("1"); addrs != nil {
+		t.Fatalf("Unexpected addresses for an unhealthy container: %v", addrs)
+	}
+}
@@ -1,73 +1,480 @@
 package localdiscovery
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	"github.com/docker/docker/api/types/swarm"
 	docker "github.com/fsouza/go-dockerclient"
 )
 
+// DefaultReconcileInterval is the period of the full container list reconciliation.
+// The cache is updated on docker events as they arrive, the reconciliation
+// catches up any missed event. It is the upper bound of the cache staleness.
+const DefaultReconcileInterval = 1 * time.Minute
+
+// Health wait settings of the lookups, see discoverclient.HealthWait.
+// The wait is bounded so the clients timeout is not reached, they retry.
+const (
+	healthWaitTimeout  = 5 * time.Second
+	healthPollInterval = 250 * time.Millisecond
+)
+
+// refreshMinInterval is the minimum delay between two on-demand reconciliations
+// triggered by a cache miss.
+const refreshMinInterval = 1 * time.Second
+
+// missTTL is the delay during which the cache misses of a caller IP are not refreshed again.
+// The callers which are not containers, ex: host processes or scanners, are served
+// from the events and periodic reconciliations only.
+const missTTL = 30 * time.Second
+
 // DockerDiscovery creates a http service
 // to lookup the exposed port of a given container.
+// Lookups are served from an in-memory index of the running containers
+// of one or more docker daemons, kept up to date via their event streams.
+// On swarm nodes, the tasks are resolved to their service published ports.
 type DockerDiscovery struct {
-	client *docker.Client
+	// TrustPolicy defines how the callers are identified. Defaults to TrustRemote.
+	// Must be set before serving lookups.
+	TrustPolicy TrustPolicy
+
+	daemons []*dockerDaemon
+	cache   *containerCache
+	metrics *metrics
+
+	missLock sync.Mutex
+	misses   map[string]time.Time // Last unresolved cache miss, keyed by caller IP.
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
-// NewDockerDiscovery instantiates a new DockerDiscovery object.
-// Connects to docker and store the socket.
+// NewDockerDiscovery instantiates a new DockerDiscovery object for a single docker daemon.
+// Connects to docker, seeds the container cache and starts
+// listening for docker events. Call Close to release the resources.
 func NewDockerDiscovery(dockerAddr string) (*DockerDiscovery, error) {
-	client, err := docker.NewClient(dockerAddr)
-	if err != nil {
+	return NewDockerDiscoveryEndpoints(DockerEndpoint{URL: dockerAddr})
+}
+
+// NewDockerDiscoveryEndpoints instantiates a new DockerDiscovery object serving
+// the containers of all the given docker endpoints. The endpoint names must be unique.
+// Fails only if all the daemons are unreachable at startup: the discovery starts degraded,
+// the failed daemons are reported unhealthy and retried. See NewDockerDiscovery.
+func NewDockerDiscoveryEndpoints(endpoints ...DockerEndpoint) (*DockerDiscovery, error) {
+	if err := validateEndpoints(endpoints); err != nil {
 		return nil, err
 	}
-	return &DockerDiscovery{
-		client: client,
-	}, nil
+	names := make([]string, 0, len(endpoints))
+	clients := make([]DockerClient, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		client, err := newDockerClient(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("docker endpoint %s: %s", endpoint, err)
+		}
+		names = append(names, endpoint.Name)
+		clients = append(clients, client)
+	}
+	return newDockerDiscovery(names, clients)
+}
+
+// NewDockerDiscoveryWithClient instantiates a new DockerDiscovery object on top of the given docker client.
+// Intended for the tests with a fake docker. See NewDockerDiscovery.
+func NewDockerDiscoveryWithClient(client DockerClient) (*DockerDiscovery, error) {
+	return newDockerDiscovery([]string{""}, []DockerClient{client})
+}
+
+// newDockerDiscovery seeds the container cache from the given named docker clients
+// and starts listening for their events.
+func newDockerDiscovery(names []string, clients []DockerClient) (*DockerDiscovery, error) {
+	d := &DockerDiscovery{
+		cache:    newContainerCache(),
+		stopChan: make(chan struct{}),
+	}
+	d.metrics = newMetrics(d)
+	for i, client := range clients {
+		d.daemons = append(d.daemons, &dockerDaemon{
+			name:    names[i],
+			client:  client,
+			cache:   d.cache,
+			metrics: d.metrics,
+		})
+	}
+	errs := d.eachDaemonErrors(func(daemon *dockerDaemon) error { return daemon.reconcile() })
+	failed := 0
+	for _, daemon := range d.daemons {
+		if err := errs[daemon.name]; err != nil {
+			daemon.log().WithError(err).Warn("unable to reach the docker endpoint, starting degraded")
+			failed++
+		}
+	}
+	if failed == len(d.daemons) {
+		return nil, d.firstDaemonError(errs)
+	}
+	for _, daemon := range d.daemons {
+		d.wg.Add(1)
+		go func(daemon *dockerDaemon) {
+			defer d.wg.Done()
+			daemon.watchEvents(DefaultReconcileInterval, d.stopChan)
+		}(daemon)
+	}
+	return d, nil
+}
+
+// Close stops the event listeners and the periodic reconciliations.
+func (d *DockerDiscovery) Close() error {
+	d.stopOnce.Do(func() { close(d.stopChan) })
+	d.wg.Wait()
+	return nil
+}
+
+// firstDaemonError returns the first of the given errors keyed by endpoint name,
+// prefixed by the endpoint name when there are several daemons.
+func (d *DockerDiscovery) firstDaemonError(errs map[string]error) error {
+	for _, daemon := range d.daemons {
+		if err := errs[daemon.name]; err != nil {
+			if len(d.daemons) > 1 {
+				return fmt.Errorf("docker endpoint %s: %s", daemon.name, err)
+			}
+			return err
+		}
+	}
+	return nil
 }
 
-// LookupPort lookup the given port for a container and return the first port value.
-// It matches based on the IP of the caller.
-func (d *DockerDiscovery) LookupPort(ip, port string) (int, error) {
+// eachDaemonErrors calls fn concurrently for each docker daemon and returns the errors keyed by endpoint name.
+func (d *DockerDiscovery) eachDaemonErrors(fn func(*dockerDaemon) error) map[string]error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(map[string]error, len(d.daemons))
+	)
+	for _, daemon := range d.daemons {
+		wg.Add(1)
+		go func(daemon *dockerDaemon) {
+			defer wg.Done()
+			err := fn(daemon)
+			mu.Lock()
+			errs[daemon.name] = err
+			mu.Unlock()
+		}(daemon)
+	}
+	wg.Wait()
+	return errs
+}
+
+// refresh reconciles the daemons not reconciled recently, concurrently.
+// Used upon cache miss to catch up with containers which events are not yet processed.
+// Fails only if all the daemons fail, the others are still served.
+func (d *DockerDiscovery) refresh() error {
+	errs := d.eachDaemonErrors(func(daemon *dockerDaemon) error { return daemon.refresh() })
+	var last error
+	for _, daemon := range d.daemons {
+		if errs[daemon.name] == nil {
+			return nil
+		}
+		last = errs[daemon.name]
+	}
+	return last
+}
+
+// LookupContainer looks up the running container of the given caller on all the docker daemons.
+// The caller is matched by IP on any of the container's networks,
+// or by its hints depending on the TrustPolicy.
+// A cache miss reconciles the daemons, unless the caller IP already missed within missTTL.
+// Fails with an ambiguous_caller API error when the caller IP belongs to containers
+// of several docker endpoints and the hostname hint doesn't tell them apart, see lookupIP,
+// or when the trusted MAC hint matches several containers, see lookupMAC.
+func (d *DockerDiscovery) LookupContainer(caller Caller) (Match, error) {
+	m, ok, err := d.cache.match(caller, d.TrustPolicy)
+	if ok || err != nil {
+		return m, err
+	}
+	if d.missedRecently(caller.RemoteIP) {
+		return Match{}, apiError(discoverclient.CodeContainerNotFound, "unable to lookup container %s", caller)
+	}
+	// The container may have started before we processed its event.
+	if err := d.refresh(); err != nil {
+		return Match{}, apiError(discoverclient.CodeBackendUnavailable, "unable to lookup container %s: %s", caller, err)
+	}
+	if m, ok, err = d.cache.match(caller, d.TrustPolicy); err != nil {
+		return Match{}, err
+	}
+	if !ok {
+		d.recordMiss(caller.RemoteIP)
+		return Match{}, apiError(discoverclient.CodeContainerNotFound, "unable to lookup container %s", caller)
+	}
+	return m, nil
+}
+
+// missedRecently checks if the given caller IP missed the cache even after a refresh within missTTL.
+func (d *DockerDiscovery) missedRecently(ip string) bool {
+	d.missLock.Lock()
+	defer d.missLock.Unlock()
+	last, ok := d.misses[ip]
+	return ok && time.Since(last) < missTTL
+}
+
+// recordMiss records an unresolved cache miss of the given caller IP and forgets the expired ones.
+func (d *DockerDiscovery) recordMiss(ip string) {
+	d.missLock.Lock()
+	defer d.missLock.Unlock()
+	if d.misses == nil {
+		d.misses = map[string]time.Time{}
+	}
+	now := time.Now()
+	for elem, last := range d.misses {
+		if now.Sub(last) >= missTTL {
+			delete(d.misses, elem)
+		}
+	}
+	d.misses[ip] = now
+}
+
+// normalizePort validates the given port and adds the default tcp protocol if missing.
+func normalizePort(port string) (string, error) {
 	// default to TCP if not specified.
 	if strings.Index(port, "/") == -1 {
 		port += "/tcp"
 	}
-	log := logrus.WithField("port", port).WithField("ip", ip)
-	// small return helper.
-	returnPort := func(cont *docker.Container) (int, error) {
-		ports, ok := cont.NetworkSettings.Ports[docker.Port(port)]
-		if !ok {
-			log.Warning("The port is not exposed")
-			return -1, nil
-		}
-		port, err := strconv.Atoi(strings.Split(ports[0].HostPort, "/")[0])
+	p := docker.Port(port)
+	if n, err := strconv.Atoi(p.Port()); err != nil || n <= 0 || n > 65535 {
+		return "", apiError(discoverclient.CodeBadRequest, "invalid port %q", p.Port())
+	}
+	if proto := p.Proto(); proto != "tcp" && proto != "udp" {
+		return "", apiError(discoverclient.CodeBadRequest, "invalid protocol %q", proto)
+	}
+	return port, nil
+}
+
+// LookupPort lookup the given port for the caller container and return all its host bindings.
+// See LookupContainer for the caller matching.
+// An exposed but unpublished port yields an empty binding list with the PortUnpublished state.
+func (d *DockerDiscovery) LookupPort(caller Caller, port string) (resp *discoverclient.LookupResponse, err error) {
+	defer func(start time.Time) { d.metrics.lookup(start, err) }(time.Now())
+
+	port, err = normalizePort(port)
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.LookupContainer(caller)
+	if err != nil {
+		return nil, err
+	}
+	return d.cache.portResponse(m.Container, m.Network, port)
+}
+
+// LookupHealthyPort looks up the given port like LookupPort and enforces the given health requirement.
+// With discoverclient.HealthWait, waits for the container to be healthy for a while
+// or until the context is done.
+// Returns a container_unhealthy API error when the container is not healthy.
+func (d *DockerDiscovery) LookupHealthyPort(ctx context.Context, caller Caller, port string, health discoverclient.HealthRequirement) (*discoverclient.LookupResponse, error) {
+	if err := validateHealth(health); err != nil {
+		return nil, err
+	}
+	resp, err := d.LookupPort(caller, port)
+	if err != nil {
+		return nil, err
+	}
+	// The cache is updated upon health_status events.
+	return enforceHealth(ctx, d.cache, resp, health)
+}
+
+// Lookup implements Backend. See LookupHealthyPort.
+func (d *DockerDiscovery) Lookup(ctx context.Context, caller Caller, port string, health discoverclient.HealthRequirement) (*discoverclient.LookupResponse, error) {
+	return d.LookupHealthyPort(ctx, caller, port, health)
+}
+
+// Self implements Backend. See LookupContainer.
+func (d *DockerDiscovery) Self(caller Caller) (*discoverclient.ContainerInfo, error) {
+	m, err := d.LookupContainer(caller)
+	if err != nil {
+		return nil, err
+	}
+	return d.cache.containerInfo(m.Container, m.Network)
+}
+
+// Watch implements Backend.
+func (d *DockerDiscovery) Watch(ctx context.Context) <-chan struct{} {
+	return d.cache.subscribe(ctx)
+}
+
+// containerHealth returns the health status of the given container.
+func containerHealth(cont *docker.Container) discoverclient.HealthStatus {
+	return discoverclient.HealthStatus(cont.State.Health.Status)
+}
+
+// isHealthy checks if the given status is healthy. Containers without healthcheck are healthy.
+func isHealthy(status discoverclient.HealthStatus) bool {
+	return status == discoverclient.HealthNone || status == discoverclient.HealthHealthy
+}
+
+// portResponse builds the lookup response for the given container port.
+// The port is expected to have the protocol suffix.
+// svc is the swarm service of the container, nil for the standalone containers.
+// The bindings of a task are its host mode ones followed by the ingress ones of the service.
+func portResponse(cont *docker.Container, svc *swarm.Service, network, port string) (*discoverclient.LookupResponse, error) {
+	log := logrus.WithField("port", port).WithField("container", cont.ID).WithField("network", network)
+	resp := &discoverclient.LookupResponse{
+		Port:      port,
+		Container: cont.ID,
+		Network:   network,
+		Bindings:  []discoverclient.PortBinding{},
+		Health:    containerHealth(cont),
+	}
+	if svc != nil {
+		resp.Service = svc.Spec.Name
+	}
+	var ports []docker.PortBinding
+	exposed := len(servicePorts(svc, port)) > 0
+	if cont.NetworkSettings != nil {
+		var ok bool
+		ports, ok = cont.NetworkSettings.Ports[docker.Port(port)]
+		exposed = exposed || ok
+	}
+	if !exposed {
+		log.Warning("The port is not exposed")
+		return nil, apiError(discoverclient.CodeNotExposed, "port %s is not exposed by container %s", port, cont.ID)
+	}
+	proto := docker.Port(port).Proto()
+	for _, binding := range ports {
+		hostPort, err := strconv.Atoi(strings.Split(binding.HostPort, "/")[0])
 		if err != nil {
 			log.WithError(err).Error("Invalid port format")
-			return -1, err
+			return nil, err
+		}
+		b := discoverclient.PortBinding{
+			HostIP:   binding.HostIP,
+			HostPort: hostPort,
+			Protocol: proto,
 		}
-		return port, nil
+		if svc != nil {
+			b.Mode = discoverclient.PublishHost
+		}
+		resp.Bindings = append(resp.Bindings, b)
+	}
+	resp.Bindings = append(resp.Bindings, ingressBindings(svc, port, resp.Bindings)...)
+	if len(resp.Bindings) == 0 {
+		log.Warning("The port is exposed but not published")
+		resp.State = discoverclient.PortUnpublished
+		return resp, nil
 	}
+	resp.State = discoverclient.PortPublished
+	return resp, nil
+}
 
-	// Lookup all containers.
-	containers, err := d.client.ListContainers(docker.ListContainersOptions{All: false})
-	if err != nil {
-		return -1, err
+// ContainerInfo returns the details of the given container along with all its ports.
+// network is the network the container has been matched on, if any.
+func ContainerInfo(cont *docker.Container, network string) (*discoverclient.ContainerInfo, error) {
+	return containerInfo(cont, nil, network)
+}
+
+// containerInfo returns the details of the given container along with all its ports
+// and the ones of its swarm service, if any.
+func containerInfo(cont *docker.Container, svc *swarm.Service, network string) (*discoverclient.ContainerInfo, error) {
+	info := &discoverclient.ContainerInfo{
+		ID:           cont.ID,
+		Name:         strings.TrimPrefix(cont.Name, "/"),
+		Image:        cont.Image,
+		Network:      network,
+		Networks:     map[string]string{},
+		IPv6Networks: map[string]string{},
+		Ports:        []discoverclient.LookupResponse{},
+		Health:       containerHealth(cont),
+	}
+	if svc != nil {
+		info.Service = svc.Spec.Name
+	}
+	for _, addr := range containerIPs(cont) {
+		if strings.Contains(addr.IP, ":") {
+			info.IPv6Networks[addr.Network] = addr.IP
+		} else {
+			info.Networks[addr.Network] = addr.IP
+		}
+	}
+	if cont.Config != nil {
+		info.Hostname = cont.Config.Hostname
+	}
+	seen := map[string]struct{}{}
+	if cont.NetworkSettings != nil {
+		for port := range cont.NetworkSettings.Ports {
+			seen[string(port)] = struct{}{}
+		}
+	}
+	if svc != nil {
+		for _, config := range svc.Endpoint.Ports {
+			seen[portConfigName(config)] = struct{}{}
+		}
+	}
+	ports := make([]string, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, port)
 	}
-	for _, cont := range containers {
-		// Fetch more details about that container.
-		cont, err := d.client.InspectContainer(cont.ID)
+	sort.Strings(ports)
+	for _, port := range ports {
+		resp, err := portResponse(cont, svc, network, port)
 		if err != nil {
-			log.WithError(err).Error("error inspecting container, skipping")
+			return nil, err
+		}
+		info.Ports = append(info.Ports, *resp)
+	}
+	return info, nil
+}
+
+// ListContainers returns the details of all the running containers.
+func (d *DockerDiscovery) ListContainers() ([]discoverclient.ContainerInfo, error) {
+	return listContainers(d.cache)
+}
+
+// Ping checks the docker daemons connectivity.
+// Fails only if all the daemons are unreachable, see Health.
+func (d *DockerDiscovery) Ping() error {
+	_, err := d.Health()
+	return err
+}
+
+// PingEndpoints checks the docker daemons connectivity concurrently.
+// Returns the ping error of each daemon keyed by endpoint name, nil for the reachable ones.
+func (d *DockerDiscovery) PingEndpoints() map[string]error {
+	return d.eachDaemonErrors(func(daemon *dockerDaemon) error { return daemon.ping() })
+}
+
+// Health implements Backend. Reports the health of each docker endpoint.
+// A daemon is unhealthy while unreachable or until its containers are listed successfully.
+// Fails only if all the daemons are unhealthy.
+func (d *DockerDiscovery) Health() (*discoverclient.HealthResponse, error) {
+	errs := d.PingEndpoints()
+	resp := &discoverclient.HealthResponse{
+		Status:    discoverclient.StatusOK,
+		Endpoints: make(map[string]string, len(errs)),
+	}
+	var msgs []string
+	for _, daemon := range d.daemons {
+		err := errs[daemon.name]
+		if err == nil {
+			err = daemon.syncError()
+		}
+		if err == nil {
+			resp.Endpoints[daemon.name] = discoverclient.StatusOK
 			continue
 		}
-		// If the hostname and IP match, we return the port.
-		if cont.NetworkSettings.IPAddress == ip {
-			return returnPort(cont)
+		resp.Endpoints[daemon.name] = err.Error()
+		resp.Status = discoverclient.StatusDegraded
+		if len(d.daemons) > 1 {
+			err = fmt.Errorf("%s: %s", daemon.name, err)
 		}
-
+		msgs = append(msgs, err.Error())
+	}
+	if len(msgs) == len(d.daemons) {
+		return nil, apiError(discoverclient.CodeBackendUnavailable, "docker unreachable: %s", strings.Join(msgs, ", "))
 	}
-	// If we reach this point, we didn't find the container.
-	return -1, fmt.Errorf("unable to lookup the port %s for container %s", port, ip)
+	return resp, nil
 }
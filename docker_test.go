@@ -0,0 +1,361 @@
+package localdiscovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	docker "github.com/fsouza/go-dockerclient"
+	dockertest "github.com/fsouza/go-dockerclient/testing"
+)
+
+// hookClient wraps a docker client to count the inspections and alter the inspected containers.
+type hookClient struct {
+	DockerClient
+
+	inspects int64                        // Accessed atomically.
+	inspect  func(cont *docker.Container) // Optional.
+}
+
+// InspectContainer implements DockerClient.
+func (c *hookClient) InspectContainer(id string) (*docker.Container, error) {
+	atomic.AddInt64(&c.inspects, 1)
+	cont, err := c.DockerClient.InspectContainer(id)
+	if err == nil && c.inspect != nil {
+		c.inspect(cont)
+	}
+	return cont, err
+}
+
+// AddEventListener implements DockerClient. The events are not listened to:
+// the docker client event monitor panics when its last listener is removed, see subscribeEvents.
+func (c *hookClient) AddEventListener(listener chan<- *docker.APIEvents) error { return nil }
+
+// RemoveEventListener implements DockerClient.
+func (c *hookClient) RemoveEventListener(listener chan *docker.APIEvents) error { return nil }
+
+// newTestDiscovery instantiates a DockerDiscovery on top of the given fake server. Call Close to release it.
+func newTestDiscovery(t *testing.T, server *dockertest.DockerServer, inspect func(cont *docker.Container)) (*DockerDiscovery, *hookClient) {
+	dockerClient, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &hookClient{DockerClient: dockerClient, inspect: inspect}
+	discovery, err := NewDockerDiscoveryWithClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return discovery, client
+}
+
+// expectAPIError checks the given error is an API error with the given code.
+func expectAPIError(t *testing.T, err error, code discoverclient.ErrorCode) {
+	apiErr, ok := err.(*discoverclient.APIError)
+	if !ok || apiErr.Code != code {
+		t.Fatalf("Unexpected error.\nExpected: %s\nGot:      %v", code, err)
+	}
+}
+
+func TestLookupContainerMatching(t *testing.T) {
+	server, stop := newFakeDocker(t)
+	defer stop()
+	a := startTestContainer(t, server, "80/tcp", "8001")
+	b := startTestContainer(t, server, "80/tcp", "8002")
+
+	// The fake server picks the IPs randomly, set known ones.
+	networks := map[string]map[string]docker.ContainerNetwork{
+		a.ID: {"bridge": {IPAddress: "10.0.0.1", MacAddress: "02:42:0a:00:00:01"}},
+		b.ID: {
+			"bridge":  {IPAddress: "10.0.0.2", MacAddress: "02:42:0a:00:00:02"},
+			"backend": {GlobalIPv6Address: "fd00::2", MacAddress: "02:42:0a:00:00:03"},
+		},
+	}
+	discovery, _ := newTestDiscovery(t, server, func(cont *docker.Container) {
+		cont.NetworkSettings.Networks = networks[cont.ID]
+	})
+	defer func() { _ = discovery.Close() }()
+
+	for _, tc := range []struct {
+		policy  TrustPolicy
+		caller  Caller
+		expect  string // Container ID, empty for not found.
+		network string
+	}{
+		{policy: TrustRemote, caller: Caller{RemoteIP: "10.0.0.1"}, expect: a.ID, network: "bridge"},
+		{policy: TrustRemote, caller: Caller{RemoteIP: "::ffff:10.0.0.2"}, expect: b.ID, network: "bridge"},
+		{policy: TrustRemote, caller: Caller{RemoteIP: "fd00:0::2"}, expect: b.ID, network: "backend"},
+		{policy: TrustRemote, caller: Caller{RemoteIP: "10.0.0.9", Hostname: a.Config.Hostname}},
+		{policy: TrustHints, caller: Caller{RemoteIP: "10.0.0.1", Hostname: b.Config.Hostname}, expect: b.ID},
+		{policy: TrustHints, caller: Caller{RemoteIP: "10.0.0.9", MAC: "02:42:0A:00:00:03"}, expect: b.ID, network: "backend"},
+		{policy: TrustHints, caller: Caller{RemoteIP: "10.0.0.9", IP: "10.0.0.1"}, expect: a.ID, network: "bridge"},
+		{policy: TrustHints, caller: Caller{RemoteIP: "10.0.0.1", MAC: "nope"}, expect: a.ID, network: "bridge"},
+		{policy: TrustFallback, caller: Caller{RemoteIP: "10.0.0.1", Hostname: b.Config.Hostname}, expect: a.ID, network: "bridge"},
+		{policy: TrustFallback, caller: Caller{RemoteIP: "10.0.0.9", Hostname: b.Config.Hostname}, expect: b.ID},
+		{policy: TrustFallback, caller: Caller{RemoteIP: "10.0.0.9", Hostname: "nope"}},
+	} {
+		discovery.TrustPolicy = tc.policy
+		m, err := discovery.LookupContainer(tc.caller)
+		if tc.expect == "" {
+			expectAPIError(t, err, discoverclient.CodeContainerNotFound)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s with %s: %s", tc.caller, tc.policy, err)
+		}
+		if m.Container.ID != tc.expect || (tc.network != "" && m.Network != tc.network) {
+			t.Fatalf("Unexpected match for %s with %s.\nExpected: %s (%s)\nGot:      %s (%s)", tc.caller, tc.policy, tc.expect, tc.network, m.Container.ID, m.Network)
+		}
+	}
+}
+
+func TestLookupPortProtocols(t *testing.T) {
+	server, stop := newFakeDocker(t)
+	defer stop()
+	cont := runTestContainer(t, server, map[docker.Port][]docker.PortBinding{
+		"80/tcp":  {{HostPort: "8080"}, {HostIP: "127.0.0.1", HostPort: "8081"}},
+		"53/udp":  {{HostPort: "5353"}},
+		"443/tcp": {},
+	})
+	discovery, _ := newTestDiscovery(t, server, nil)
+	defer func() { _ = discovery.Close() }()
+	discovery.TrustPolicy = TrustHints
+	router := discovery.Router()
+
+	for _, tc := range []struct {
+		port      string
+		code      int
+		errCode   discoverclient.ErrorCode
+		state     discoverclient.PortState
+		proto     string
+		hostPorts []int
+	}{
+		{port: "80", code: http.StatusOK, state: discoverclient.PortPublished, proto: "tcp", hostPorts: []int{8080, 8081}},
+		{port: "80/tcp", code: http.StatusOK, state: discoverclient.PortPublished, proto: "tcp", hostPorts: []int{8080, 8081}},
+		{port: "53/udp", code: http.StatusOK, state: discoverclient.PortPublished, proto: "udp", hostPorts: []int{5353}},
+		{port: "443", code: http.StatusOK, state: discoverclient.PortUnpublished, proto: "tcp"},
+		{port: "53", code: http.StatusNotFound, errCode: discoverclient.CodeNotExposed},
+		{port: "80/udp", code: http.StatusNotFound, errCode: discoverclient.CodeNotExposed},
+		{port: "8080", code: http.StatusNotFound, errCode: discoverclient.CodeNotExposed},
+		{port: "80/sctp", code: http.StatusBadRequest, errCode: discoverclient.CodeBadRequest},
+		{port: "0", code: http.StatusBadRequest, errCode: discoverclient.CodeBadRequest},
+		{port: "http", code: http.StatusBadRequest, errCode: discoverclient.CodeBadRequest},
+	} {
+		// The legacy lookup returns the first host port, 0 when not exposed.
+		body, err := json.Marshal(discoverclient.LookupRequest{Port: tc.port, Hostname: cont.Config.Hostname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+		switch {
+		case tc.code == http.StatusOK, tc.errCode == discoverclient.CodeNotExposed:
+			var port int
+			if err := json.NewDecoder(w.Body).Decode(&port); err != nil {
+				t.Fatalf("Unexpected legacy response for %s: %s", tc.port, err)
+			}
+			expect := 0
+			if len(tc.hostPorts) > 0 {
+				expect = tc.hostPorts[0]
+			}
+			if w.Code != http.StatusOK || port != expect {
+				t.Fatalf("Unexpected legacy port for %s.\nExpected: %d\nGot:      %d (%d)", tc.port, expect, port, w.Code)
+			}
+		default:
+			if w.Code != tc.code {
+				t.Fatalf("Unexpected legacy status code for %s.\nExpected: %d\nGot:      %d (%s)", tc.port, tc.code, w.Code, w.Body)
+			}
+		}
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", selfPortsPath+tc.port+"?hostname="+url.QueryEscape(cont.Config.Hostname), nil))
+		if w.Code != tc.code {
+			t.Fatalf("Unexpected status code for %s.\nExpected: %d\nGot:      %d (%s)", tc.port, tc.code, w.Code, w.Body)
+		}
+		if tc.code != http.StatusOK {
+			var errResp discoverclient.ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
+				t.Fatal(err)
+			}
+			if errResp.Error == nil || errResp.Error.Code != tc.errCode {
+				t.Fatalf("Unexpected error for %s.\nExpected: %s\nGot:      %+v", tc.port, tc.errCode, errResp.Error)
+			}
+			continue
+		}
+		var resp discoverclient.LookupResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Container != cont.ID || resp.State != tc.state || resp.Port != normalizedTestPort(tc.port) || len(resp.Bindings) != len(tc.hostPorts) {
+			t.Fatalf("Unexpected response for %s: %+v", tc.port, resp)
+		}
+		for i, binding := range resp.Bindings {
+			if binding.Protocol != tc.proto || binding.HostPort != tc.hostPorts[i] {
+				t.Fatalf("Unexpected binding %d for %s: %+v", i, tc.port, binding)
+			}
+		}
+	}
+
+	// The handlers can be served on top of the discovery directly.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("{")))
+	if err := NewHandlers(discovery).LookupHandler(w, req); err == nil {
+		t.Fatal("Expected error for an invalid request")
+	} else {
+		expectAPIError(t, err, discoverclient.CodeBadRequest)
+	}
+
+	// The deprecated discovery handler still serves the legacy lookup.
+	body, err := json.Marshal(discoverclient.LookupRequest{Port: "53/udp", Hostname: cont.Config.Hostname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if err := discovery.LookupHandler(w, httptest.NewRequest("POST", "/lookup", bytes.NewReader(body))); err != nil {
+		t.Fatal(err)
+	}
+	if port := strings.TrimSpace(w.Body.String()); port != "5353" {
+		t.Fatalf("Unexpected legacy port.\nExpected: %s\nGot:      %s", "5353", port)
+	}
+}
+
+// normalizedTestPort adds the default tcp protocol to the given port.
+func normalizedTestPort(port string) string {
+	if p := docker.Port(port); p.Proto() == "tcp" {
+		return p.Port() + "/tcp"
+	}
+	return port
+}
+
+func TestLookupInspectFailure(t *testing.T) {
+	server, stop := newFakeDocker(t)
+	defer stop()
+	ok := startTestContainer(t, server, "80/tcp", "8001")
+	failing := startTestContainer(t, server, "80/tcp", "8002")
+
+	// Fails at startup when the containers can't be listed.
+	server.PrepareFailure("list", "^/containers/json$")
+	if discovery, err := NewDockerDiscovery(server.URL()); err == nil {
+		_ = discovery.Close()
+		t.Fatal("Expected error when the containers can't be listed")
+	}
+	server.ResetFailure("list")
+
+	// The containers failing to be inspected are skipped.
+	server.PrepareFailure("inspect", "^/containers/"+failing.ID+"/json$")
+	discovery, client := newTestDiscovery(t, server, nil)
+	defer func() { _ = discovery.Close() }()
+	discovery.TrustPolicy = TrustHints
+	if _, err := discovery.LookupPort(Caller{Hostname: ok.Config.Hostname}, "80"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := discovery.LookupPort(Caller{Hostname: failing.Config.Hostname}, "80")
+	expectAPIError(t, err, discoverclient.CodeContainerNotFound)
+	if inspects := atomic.LoadInt64(&client.inspects); inspects != 2 {
+		t.Fatalf("Unexpected inspect count.\nExpected: %d\nGot:      %d", 2, inspects)
+	}
+
+	// The next reconciliation catches up.
+	server.ResetFailure("inspect")
+	if err := discovery.daemons[0].reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := discovery.LookupPort(Caller{Hostname: failing.Config.Hostname}, "80"); err != nil || resp.Container != failing.ID {
+		t.Fatalf("Unexpected lookup after reconciliation: %+v (%v)", resp, err)
+	}
+
+	// The cache misses fail when docker is unreachable.
+	server.PrepareFailure("list", "^/containers/json$")
+	time.Sleep(refreshMinInterval)
+	_, err = discovery.LookupPort(Caller{RemoteIP: "10.0.0.9", Hostname: "nope"}, "80")
+	expectAPIError(t, err, discoverclient.CodeBackendUnavailable)
+	// The known containers are still served.
+	if _, err := discovery.LookupPort(Caller{Hostname: ok.Config.Hostname}, "80"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookupConcurrent(t *testing.T) {
+	server, stop := newFakeDocker(t)
+	defer stop()
+	var conts []*docker.Container
+	for i := 0; i < 4; i++ {
+		conts = append(conts, startTestContainer(t, server, "80/tcp", fmt.Sprintf("%d", 8000+i)))
+	}
+	discovery, client := newTestDiscovery(t, server, nil)
+	defer func() { _ = discovery.Close() }()
+	discovery.TrustPolicy = TrustHints
+	router := discovery.Router()
+	inspects := atomic.LoadInt64(&client.inspects)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cont := conts[i%len(conts)]
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", selfPortsPath+"80?hostname="+cont.Config.Hostname, nil))
+			var resp discoverclient.LookupResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				errs <- err
+				return
+			}
+			if w.Code != http.StatusOK || resp.Container != cont.ID || len(resp.Bindings) != 1 || resp.Bindings[0].HostPort != 8000+i%len(conts) {
+				errs <- fmt.Errorf("unexpected response for %s: %d %+v", cont.ID, w.Code, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	// The lookups are served from the cache.
+	if got := atomic.LoadInt64(&client.inspects); got != inspects {
+		t.Fatalf("Unexpected inspections during the lookups.\nExpected: %d\nGot:      %d", inspects, got)
+	}
+}
+
+func TestPortResponseBindings(t *testing.T) {
+	cont := &docker.Container{ID: "web", NetworkSettings: &docker.NetworkSettings{Ports: map[docker.Port][]docker.PortBinding{
+		"80/tcp":  {{HostIP: "0.0.0.0", HostPort: "8080"}, {HostIP: "::", HostPort: "8080"}, {HostIP: "127.0.0.1", HostPort: "9090"}},
+		"53/udp":  {{HostIP: "0.0.0.0", HostPort: "5353"}},
+		"443/tcp": nil,
+	}}}
+
+	for _, tc := range []struct {
+		port   string
+		state  discoverclient.PortState
+		expect []discoverclient.PortBinding
+	}{
+		{port: "80/tcp", state: discoverclient.PortPublished, expect: []discoverclient.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: 8080, Protocol: "tcp"},
+			{HostIP: "::", HostPort: 8080, Protocol: "tcp"},
+			{HostIP: "127.0.0.1", HostPort: 9090, Protocol: "tcp"},
+		}},
+		{port: "53/udp", state: discoverclient.PortPublished, expect: []discoverclient.PortBinding{{HostIP: "0.0.0.0", HostPort: 5353, Protocol: "udp"}}},
+		{port: "443/tcp", state: discoverclient.PortUnpublished, expect: []discoverclient.PortBinding{}},
+	} {
+		resp, err := portResponse(cont, nil, "bridge", tc.port)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", tc.port, err)
+		}
+		if resp.State != tc.state || !reflect.DeepEqual(resp.Bindings, tc.expect) {
+			t.Fatalf("Unexpected response for %s.\nExpected: %s %+v\nGot:      %s %+v", tc.port, tc.state, tc.expect, resp.State, resp.Bindings)
+		}
+	}
+
+	_, err := portResponse(cont, nil, "bridge", "81/tcp")
+	expectAPIError(t, err, discoverclient.CodeNotExposed)
+}
@@ -0,0 +1,51 @@
+package localdiscovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	"github.com/creack/ehttp"
+)
+
+// statusCodes maps the API error codes to their http status.
+var statusCodes = map[discoverclient.ErrorCode]int{
+	discoverclient.CodeBadRequest:         http.StatusBadRequest,
+	discoverclient.CodeContainerNotFound:  http.StatusNotFound,
+	discoverclient.CodeNotExposed:         http.StatusNotFound,
+	discoverclient.CodeBackendUnavailable: http.StatusServiceUnavailable,
+	discoverclient.CodeContainerUnhealthy: http.StatusConflict,
+	discoverclient.CodeAmbiguousCaller:    http.StatusConflict,
+	discoverclient.CodeNotFound:           http.StatusNotFound,
+	discoverclient.CodeMethodNotAllowed:   http.StatusMethodNotAllowed,
+	discoverclient.CodeInternal:           http.StatusInternalServerError,
+}
+
+// apiError creates a new API error with the given code.
+func apiError(code discoverclient.ErrorCode, f string, args ...interface{}) error {
+	return &discoverclient.APIError{Code: code, Message: fmt.Sprintf(f, args...)}
+}
+
+// apiHandler converts the API errors returned by the handler to http errors with the matching status.
+func apiHandler(handler ehttp.HandlerFunc) ehttp.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		err := handler(w, req)
+		if e, ok := err.(*discoverclient.APIError); ok {
+			return ehttp.NewError(statusCodes[e.Code], e)
+		}
+		return err
+	}
+}
+
+// sendError sends the error to the client within the discoverclient.ErrorResponse envelope.
+func sendError(w ehttp.ResponseWriter, _ *http.Request, err error) {
+	if e, ok := err.(*ehttp.Error); ok {
+		err = e.GetError()
+	}
+	apiErr, ok := err.(*discoverclient.APIError)
+	if !ok {
+		apiErr = &discoverclient.APIError{Code: discoverclient.CodeInternal, Message: err.Error()}
+	}
+	_ = json.NewEncoder(w).Encode(discoverclient.ErrorResponse{Error: apiErr}) // Best effort.
+}
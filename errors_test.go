@@ -0,0 +1,47 @@
+package localdiscovery
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	"github.com/creack/ehttp"
+)
+
+func TestAPIErrorResponses(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		code    int
+		errCode discoverclient.ErrorCode
+	}{
+		{err: apiError(discoverclient.CodeBadRequest, "invalid port"), code: http.StatusBadRequest, errCode: discoverclient.CodeBadRequest},
+		{err: apiError(discoverclient.CodeContainerNotFound, "no container"), code: http.StatusNotFound, errCode: discoverclient.CodeContainerNotFound},
+		{err: apiError(discoverclient.CodeNotExposed, "not exposed"), code: http.StatusNotFound, errCode: discoverclient.CodeNotExposed},
+		{err: apiError(discoverclient.CodeBackendUnavailable, "docker down"), code: http.StatusServiceUnavailable, errCode: discoverclient.CodeBackendUnavailable},
+		{err: apiError(discoverclient.CodeContainerUnhealthy, "unhealthy"), code: http.StatusConflict, errCode: discoverclient.CodeContainerUnhealthy},
+		{err: apiError(discoverclient.CodeAmbiguousCaller, "ambiguous"), code: http.StatusConflict, errCode: discoverclient.CodeAmbiguousCaller},
+		{err: apiError(discoverclient.CodeMethodNotAllowed, "nope"), code: http.StatusMethodNotAllowed, errCode: discoverclient.CodeMethodNotAllowed},
+		// Other errors are internal.
+		{err: errors.New("boom"), code: http.StatusInternalServerError, errCode: discoverclient.CodeInternal},
+	} {
+		mux := ehttp.NewServeMux(sendError, "application/json; charset=utf-8", true, nil)
+		err := tc.err
+		mux.HandleFunc("/", apiHandler(func(w http.ResponseWriter, req *http.Request) error { return err }))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if w.Code != tc.code {
+			t.Fatalf("Unexpected status code for %v.\nExpected: %d\nGot:      %d", tc.err, tc.code, w.Code)
+		}
+		var resp discoverclient.ErrorResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Invalid error response for %v: %s", tc.err, err)
+		}
+		if resp.Error == nil || resp.Error.Code != tc.errCode || resp.Error.Message != tc.err.Error() {
+			t.Fatalf("Unexpected error response for %v.\nExpected: %s\nGot:      %+v", tc.err, tc.errCode, resp.Error)
+		}
+	}
+}
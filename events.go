@@ -0,0 +1,252 @@
+package localdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// eventRetryDelay is the delay before re-subscribing to the docker events
+// or reconciling the cache again after a failure. Variable for the tests.
+var eventRetryDelay = 5 * time.Second
+
+// watchEvents keeps the cache in sync with the docker events
+// and fully reconciles it every reconcileInterval.
+// A failed reconciliation, including the one at startup, is retried after eventRetryDelay.
+// Blocks until stopChan is closed.
+func (d *dockerDaemon) watchEvents(reconcileInterval time.Duration, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	var (
+		events      <-chan *docker.APIEvents
+		unsubscribe func()
+		retry       <-chan time.Time
+		resync      <-chan time.Time
+	)
+	reconcile := func() {
+		if err := d.reconcile(); err != nil {
+			d.log().WithError(err).Error("error reconciling the container cache")
+			resync = time.After(eventRetryDelay)
+			return
+		}
+		resync = nil
+	}
+	subscribe := func() {
+		start := time.Now()
+		var err error
+		events, unsubscribe, err = d.subscribeEvents()
+		d.dockerCall("add_event_listener", start, err)
+		if err != nil {
+			d.log().WithError(err).Error("error listening for docker events")
+			events, retry = nil, time.After(eventRetryDelay)
+			return
+		}
+		d.metrics.eventListener(+1)
+		retry = nil
+	}
+	release := func() {
+		unsubscribe()
+		d.metrics.eventListener(-1)
+		events, unsubscribe = nil, nil
+	}
+	defer func() {
+		if events != nil {
+			release()
+		}
+	}()
+
+	subscribe()
+	if d.syncError() != nil {
+		// Unreachable at startup.
+		resync = time.After(eventRetryDelay)
+	}
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			reconcile()
+		case <-resync:
+			reconcile()
+		case <-retry:
+			d.metrics.eventReconnect(d.name)
+			subscribe()
+			// We may have missed events while disconnected.
+			reconcile()
+		case ev, open := <-events:
+			if !open {
+				d.log().Warn("docker event stream closed, reconnecting")
+				release()
+				retry = time.After(eventRetryDelay)
+				continue
+			}
+			d.handleEvent(ev)
+		}
+	}
+}
+
+// subscribeEvents subscribes to the docker events of the daemon.
+// The returned channel is closed when the stream ends, unsubscribe releases the subscription.
+// The events of a *docker.Client are streamed directly from the docker API: its event
+// monitor keeps sending on its internal channels after closing them when the last listener
+// is removed, which panics.
+func (d *dockerDaemon) subscribeEvents() (events <-chan *docker.APIEvents, unsubscribe func(), err error) {
+	if client, ok := d.client.(*docker.Client); ok {
+		return streamEvents(client)
+	}
+	listener := make(chan *docker.APIEvents, 100)
+	if err := d.client.AddEventListener(listener); err != nil {
+		return nil, nil, err
+	}
+	return listener, func() { removeEventListener(d.client, listener) }, nil
+}
+
+// removeEventListener unsubscribes the given listener from the docker events.
+// The docker client holds the lock needed to remove a listener while sending to it,
+// so keep draining the listener until it is removed.
+func removeEventListener(client DockerClient, listener chan *docker.APIEvents) {
+	removed := make(chan struct{})
+	go func() {
+		_ = client.RemoveEventListener(listener) // Best effort.
+		close(removed)
+	}()
+	drain := listener
+	for {
+		select {
+		case <-removed:
+			return
+		case _, open := <-drain:
+			if !open {
+				drain = nil
+			}
+		}
+	}
+}
+
+// streamEvents requests the docker event stream of the given client.
+// The returned channel is closed when the stream ends, cancel closes the stream.
+func streamEvents(client *docker.Client) (events <-chan *docker.APIEvents, cancel func(), err error) {
+	endpoint, err := url.Parse(client.Endpoint())
+	if err != nil {
+		return nil, nil, err
+	}
+	// Dial the daemon the way the docker client does.
+	network, address, host := "tcp", endpoint.Host, endpoint.Host
+	if endpoint.Scheme == "unix" || endpoint.Scheme == "npipe" {
+		network, address, host = endpoint.Scheme, endpoint.Path, "docker"
+	}
+	scheme := "http"
+	if client.TLSConfig != nil {
+		scheme = "https"
+	}
+	dialer := client.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	httpClient := &http.Client{Transport: &http.Transport{
+		Dial:              func(string, string) (net.Conn, error) { return dialer.Dial(network, address) },
+		TLSClientConfig:   client.TLSConfig,
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequest("GET", scheme+"://"+host+"/events", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close() // Best effort.
+		cancel()
+		return nil, nil, fmt.Errorf("unexpected docker events status: %s", resp.Status)
+	}
+
+	stream := make(chan *docker.APIEvents, 100)
+	go func() {
+		defer close(stream)
+		defer func() { _ = resp.Body.Close() }() // Best effort.
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			ev := &docker.APIEvents{}
+			if err := decoder.Decode(ev); err != nil {
+				if _, ok := err.(*json.UnmarshalTypeError); ok {
+					// The invalid event has been consumed, the stream is still usable.
+					continue
+				}
+				return
+			}
+			select {
+			case stream <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stream, cancel, nil
+}
+
+// handleEvent updates the cache for the given docker event.
+func (d *dockerDaemon) handleEvent(ev *docker.APIEvents) {
+	action, id := ev.Action, ev.Actor.ID
+	if action == "" { // API < 1.22.
+		action, id = ev.Status, ev.ID
+	}
+	switch ev.Type {
+	case "network":
+		if action != "connect" && action != "disconnect" {
+			return
+		}
+		id = ev.Actor.Attributes["container"]
+	case "", "container":
+		switch {
+		case action == "start", strings.HasPrefix(action, "health_status"):
+		case action == "die", action == "destroy":
+			d.cache.remove(id)
+			return
+		default:
+			return
+		}
+	default:
+		return
+	}
+	if id == "" {
+		return
+	}
+	d.updateContainer(id)
+}
+
+// updateContainer inspects the given container and updates the cache accordingly.
+func (d *dockerDaemon) updateContainer(id string) {
+	start := time.Now()
+	cont, err := d.client.InspectContainer(id)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		// Expected for the containers already gone.
+		d.dockerCall("inspect_container", start, nil)
+	} else {
+		d.dockerCall("inspect_container", start, err)
+	}
+	if err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			d.cache.remove(id)
+			return
+		}
+		d.log().WithError(err).WithField("container", id).Error("error inspecting container")
+		return
+	}
+	if !cont.State.Running {
+		d.cache.remove(id)
+		return
+	}
+	d.cache.setTask(d.name, cont, d.taskService(cont))
+}
@@ -0,0 +1,378 @@
+package localdiscovery
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// fakeClient is an in-memory DockerClient.
+// Like the docker client, it holds the listeners lock while sending the events.
+type fakeClient struct {
+	mu         sync.Mutex
+	containers map[string]*docker.Container
+	listErr    error
+	inspectErr error
+	inspecting chan struct{} // Blocks the inspections until closed, when set.
+
+	listenersLock sync.RWMutex
+	listeners     []chan<- *docker.APIEvents
+}
+
+func newFakeClient(containers ...*docker.Container) *fakeClient {
+	c := &fakeClient{containers: map[string]*docker.Container{}}
+	for _, cont := range containers {
+		c.set(cont)
+	}
+	return c
+}
+
+// set adds or replaces the given container.
+func (c *fakeClient) set(cont *docker.Container) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.containers[cont.ID] = cont
+}
+
+// remove removes the given container.
+func (c *fakeClient) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.containers, id)
+}
+
+// send sends the given event to the listeners, blocking until they receive it.
+func (c *fakeClient) send(ev *docker.APIEvents) {
+	c.listenersLock.RLock()
+	defer c.listenersLock.RUnlock()
+	for _, listener := range c.listeners {
+		listener <- ev
+	}
+}
+
+func (c *fakeClient) Ping() error { return nil }
+
+func (c *fakeClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listErr != nil {
+		return nil, c.listErr
+	}
+	var containers []docker.APIContainers
+	for id, cont := range c.containers {
+		if cont.State.Running {
+			containers = append(containers, docker.APIContainers{ID: id})
+		}
+	}
+	return containers, nil
+}
+
+func (c *fakeClient) InspectContainer(id string) (*docker.Container, error) {
+	c.mu.Lock()
+	inspecting := c.inspecting
+	c.mu.Unlock()
+	if inspecting != nil {
+		<-inspecting
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inspectErr != nil {
+		return nil, c.inspectErr
+	}
+	cont, ok := c.containers[id]
+	if !ok {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	dup := *cont
+	return &dup, nil
+}
+
+func (c *fakeClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+	c.listeners = append(c.listeners, listener)
+	return nil
+}
+
+func (c *fakeClient) RemoveEventListener(listener chan *docker.APIEvents) error {
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+	for i, l := range c.listeners {
+		if l == listener {
+			c.listeners = append(c.listeners[:i], c.listeners[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (c *fakeClient) ListTasks(opts docker.ListTasksOptions) ([]swarm.Task, error) {
+	return nil, errors.New("not a swarm manager")
+}
+
+func (c *fakeClient) InspectService(id string) (*swarm.Service, error) {
+	return nil, errors.New("not a swarm manager")
+}
+
+// fakeContainer returns a running container with the given ID and bridge IP.
+func fakeContainer(id, ip string) *docker.Container {
+	return &docker.Container{
+		ID:     id,
+		Config: &docker.Config{Hostname: id},
+		State:  docker.State{Running: true},
+		NetworkSettings: &docker.NetworkSettings{
+			IPAddress: ip,
+			Networks:  map[string]docker.ContainerNetwork{"bridge": {IPAddress: ip}},
+		},
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	client := newFakeClient(fakeContainer("a", "172.17.0.2"))
+	discovery, err := NewDockerDiscoveryWithClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+	daemon := discovery.daemons[0]
+
+	expectIP := func(id, ip string) {
+		cont, ok := discovery.cache.get(id)
+		if ip == "" {
+			if ok {
+				t.Fatalf("Unexpected container %s in cache", id)
+			}
+			return
+		}
+		if !ok {
+			t.Fatalf("Container %s not found in cache", id)
+		}
+		if cont.NetworkSettings.IPAddress != ip {
+			t.Fatalf("Unexpected IP for %s.\nExpected: %s\nGot:      %s", id, ip, cont.NetworkSettings.IPAddress)
+		}
+		if m, ok, err := discovery.cache.lookupIP(ip, Caller{}); err != nil || !ok || m.Container.ID != id {
+			t.Fatalf("Unexpected lookup of %s: %+v, %t (%v)", ip, m, ok, err)
+		}
+	}
+	expectIP("a", "172.17.0.2")
+
+	// Start, new and old API.
+	client.set(fakeContainer("b", "172.17.0.3"))
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "b"}})
+	expectIP("b", "172.17.0.3")
+	client.set(fakeContainer("c", "172.17.0.4"))
+	daemon.handleEvent(&docker.APIEvents{Status: "start", ID: "c"})
+	expectIP("c", "172.17.0.4")
+
+	// Ignored events.
+	client.set(fakeContainer("d", "172.17.0.5"))
+	for _, ev := range []*docker.APIEvents{
+		{Type: "container", Action: "create", Actor: docker.APIActor{ID: "d"}},
+		{Type: "image", Action: "pull", Actor: docker.APIActor{ID: "d"}},
+		{Type: "network", Action: "create", Actor: docker.APIActor{ID: "bridge", Attributes: map[string]string{"container": "d"}}},
+		{Type: "network", Action: "connect", Actor: docker.APIActor{ID: "bridge"}},
+	} {
+		daemon.handleEvent(ev)
+		expectIP("d", "")
+	}
+
+	// Network connect and disconnect re-inspect the container.
+	client.set(fakeContainer("a", "10.0.0.2"))
+	daemon.handleEvent(&docker.APIEvents{Type: "network", Action: "connect", Actor: docker.APIActor{ID: "custom", Attributes: map[string]string{"container": "a"}}})
+	expectIP("a", "10.0.0.2")
+	client.set(fakeContainer("a", "172.17.0.2"))
+	daemon.handleEvent(&docker.APIEvents{Type: "network", Action: "disconnect", Actor: docker.APIActor{ID: "custom", Attributes: map[string]string{"container": "a"}}})
+	expectIP("a", "172.17.0.2")
+	if _, ok, _ := discovery.cache.lookupIP("10.0.0.2", Caller{}); ok {
+		t.Fatal("Unexpected match for the disconnected IP")
+	}
+
+	// Health status.
+	healthy := fakeContainer("a", "172.17.0.2")
+	healthy.State.Health.Status = "healthy"
+	client.set(healthy)
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "health_status: healthy", Actor: docker.APIActor{ID: "a"}})
+	if cont, ok := discovery.cache.get("a"); !ok || cont.State.Health.Status != "healthy" {
+		t.Fatalf("Unexpected health for a: %+v", cont)
+	}
+
+	// Inspect failures keep the cache as is.
+	client.mu.Lock()
+	client.inspectErr = errors.New("fail")
+	client.mu.Unlock()
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "a"}})
+	expectIP("a", "172.17.0.2")
+	client.mu.Lock()
+	client.inspectErr = nil
+	client.mu.Unlock()
+
+	// Die and destroy remove the container without inspecting it.
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "a"}})
+	expectIP("a", "")
+	daemon.handleEvent(&docker.APIEvents{Status: "destroy", ID: "b"})
+	expectIP("b", "")
+
+	// Containers gone or stopped before the inspection.
+	client.remove("c")
+	daemon.handleEvent(&docker.APIEvents{Type: "network", Action: "disconnect", Actor: docker.APIActor{ID: "bridge", Attributes: map[string]string{"container": "c"}}})
+	expectIP("c", "")
+	stopped := fakeContainer("d", "172.17.0.5")
+	stopped.State.Running = false
+	client.set(stopped)
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "d"}})
+	expectIP("d", "")
+}
+
+func TestWatchEvents(t *testing.T) {
+	client := newFakeClient()
+	discovery, err := NewDockerDiscoveryWithClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the listener.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client.listenersLock.RLock()
+		n := len(client.listeners)
+		client.listenersLock.RUnlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the event listener")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.set(fakeContainer("a", "172.17.0.2"))
+	client.send(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "a"}})
+	for {
+		if _, ok := discovery.cache.get("a"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the container")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Fill the listener while the events are being handled
+	// and close while the client is blocked sending to it.
+	inspecting := make(chan struct{})
+	client.mu.Lock()
+	client.inspecting = inspecting
+	client.mu.Unlock()
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			client.send(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "a"}})
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		_ = discovery.Close()
+		close(closed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(inspecting)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout closing the discovery")
+	}
+	close(stop)
+	<-sent
+	if n := len(client.listeners); n != 0 {
+		t.Fatalf("Unexpected listeners after close: %d", n)
+	}
+}
+
+func TestDockerDiscoveryStreamEvents(t *testing.T) {
+	server, stop := newFakeDocker(t)
+	defer stop()
+
+	// Stream the given events until the client goes away.
+	events := make(chan *docker.APIEvents)
+	disconnected := make(chan struct{}, 1)
+	server.CustomHandler("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case ev := <-events:
+				_ = encoder.Encode(ev)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				disconnected <- struct{}{}
+				return
+			}
+		}
+	}))
+
+	for i := 0; i < 3; i++ {
+		discovery, err := NewDockerDiscovery(server.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cont := startTestContainer(t, server, "80/tcp", "8080")
+		deadline := time.After(5 * time.Second)
+		for sent := false; !sent; {
+			select {
+			case events <- &docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: cont.ID}}:
+				sent = true
+			case <-deadline:
+				t.Fatal("Timeout waiting for the event stream")
+			}
+		}
+		for {
+			if _, ok := discovery.cache.get(cont.ID); ok {
+				break
+			}
+			select {
+			case <-deadline:
+				t.Fatal("Timeout waiting for the started container")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+
+		_ = discovery.Close()
+		select {
+		case <-disconnected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for the event stream to be closed")
+		}
+	}
+}
+
+func TestDockerDiscoveryCloseEvents(t *testing.T) {
+	// The fake server streams random events, in an invalid format.
+	server, stop := newFakeDocker(t)
+	defer stop()
+	startTestContainer(t, server, "80/tcp", "8080")
+
+	for i := 0; i < 3; i++ {
+		discovery, err := NewDockerDiscovery(server.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		_ = discovery.Close()
+	}
+}
@@ -2,6 +2,7 @@ package localdiscovery
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 	"strings"
 
@@ -9,27 +10,176 @@ import (
 	"github.com/agrarianlabs/localdiscovery/discoverclient"
 )
 
+// Version is the version of the discover service.
+// Overridden at build time via -ldflags "-X github.com/agrarianlabs/localdiscovery.Version=x.y.z".
+var Version = "dev"
+
+// remoteIP returns the IP of the caller. Supports IPv4 and IPv6.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// No port.
+		return normalizeIP(req.RemoteAddr)
+	}
+	return normalizeIP(host)
+}
+
+// queryCaller returns the caller identity from the request remote address and query hints.
+func queryCaller(req *http.Request) Caller {
+	query := req.URL.Query()
+	return Caller{
+		RemoteIP: remoteIP(req),
+		Hostname: query.Get("hostname"),
+		IP:       query.Get("ip"),
+		MAC:      query.Get("mac"),
+	}
+}
+
+// writeJSON sends the given value as json.
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Handlers serves the discover API on top of a Backend.
+type Handlers struct {
+	Backend Backend
+}
+
+// NewHandlers instantiates the handlers of the given backend.
+func NewHandlers(backend Backend) *Handlers {
+	return &Handlers{Backend: backend}
+}
+
 // LookupHandler looks up the exposed port for a given container on the host.
+//
+// Legacy route kept for the pre-v1 clients, see SelfPortHandler for the detailed lookup.
 // Method: POST
 // Content-Type: application/json
-// Request: (see HostInfo{})
+// Request: (see discoverclient.LookupRequest{})
 //   - hostname (string): hostname of the target host
 //   - ip       (string): ip of the target host
 //   - mac      (string): hardware address of the target host
 //   - port     (string): port as a string. ex: 80, 8080/tcp, 8125/udp
+//   - health   (string): optional, fail or wait while the container is not healthy
+// The hostname, ip and mac hints are used according to the TrustPolicy.
 // Response:
 //   - port        (int): first exposed port public value. 0 means not exposed.
-func (d *DockerDiscovery) LookupHandler(w http.ResponseWriter, req *http.Request) error {
+// Errors: (see discoverclient.ErrorResponse{})
+//   - 400 bad_request:         invalid request or port
+//   - 404 container_not_found: no running container matches the caller
+//   - 409 container_unhealthy: the container is not healthy, with the health requirement
+//   - 409 ambiguous_caller:    the caller IP belongs to containers of several docker endpoints
+//                              and the hostname hint doesn't tell them apart,
+//                              or the trusted mac hint matches several containers
+//   - 503 backend_unavailable: the backend is unavailable. ex: docker is unreachable
+func (h *Handlers) LookupHandler(w http.ResponseWriter, req *http.Request) error {
 	lookupReq := discoverclient.LookupRequest{}
 	err := json.NewDecoder(req.Body).Decode(&lookupReq)
 	_ = req.Body.Close() // best effort.
 	if err != nil {
+		return apiError(discoverclient.CodeBadRequest, "invalid request: %s", err)
+	}
+	caller := Caller{
+		RemoteIP: remoteIP(req),
+		Hostname: lookupReq.Hostname,
+		IP:       lookupReq.IP,
+		MAC:      lookupReq.MAC,
+	}
+	port := 0
+	resp, err := h.Backend.Lookup(req.Context(), caller, lookupReq.Port, lookupReq.Health)
+	apiErr, _ := err.(*discoverclient.APIError)
+	switch {
+	case err == nil:
+		if len(resp.Bindings) > 0 {
+			port = resp.Bindings[0].HostPort
+		}
+	case apiErr != nil && apiErr.Code == discoverclient.CodeNotExposed:
+		// The legacy clients expect 0 when the port is not exposed.
+	default:
 		return err
 	}
-	port, err := d.LookupPort(strings.Split(req.RemoteAddr, ":")[0], lookupReq.Port)
+	logrus.Printf("Lookup result for %s:%s is %d", caller, lookupReq.Port, port)
+	return json.NewEncoder(w).Encode(port)
+}
+
+// LookupHandler looks up the exposed port for a given container on the host.
+//
+// Deprecated: use NewHandlers(d).LookupHandler or Router.
+func (d *DockerDiscovery) LookupHandler(w http.ResponseWriter, req *http.Request) error {
+	return NewHandlers(d).LookupHandler(w, req)
+}
+
+// SelfPortHandler looks up the given port for the calling container.
+// Method: GET
+// Path: /v1/self/ports/{port}. ex: /v1/self/ports/80, /v1/self/ports/8125/udp
+// Query: hostname, ip and mac hints, health requirement. See LookupHandler.
+// Response: (see discoverclient.LookupResponse{})
+//   - port      (string): container port. ex: 80/tcp
+//   - container (string): id of the matched container
+//   - network   (string): name of the network the caller matched on
+//   - state     (string): published or unpublished (exposed but not published)
+//   - bindings  (array):  host bindings of the port (host_ip, host_port, protocol and swarm mode)
+//   - health    (string): starting, healthy or unhealthy, if the container has a healthcheck
+//   - service   (string): swarm service name, if the container is a task
+//   - endpoint  (string): name of the docker endpoint running the container
+// Errors: same as LookupHandler, plus:
+//   - 404 not_exposed:         the port is not exposed by the container
+func (h *Handlers) SelfPortHandler(w http.ResponseWriter, req *http.Request) error {
+	port := strings.TrimPrefix(req.URL.Path, selfPortsPath)
+	if port == "" {
+		return apiError(discoverclient.CodeBadRequest, "missing port")
+	}
+	caller := queryCaller(req)
+	health := discoverclient.HealthRequirement(req.URL.Query().Get("health"))
+	resp, err := h.Backend.Lookup(req.Context(), caller, port, health)
 	if err != nil {
 		return err
 	}
-	logrus.Printf("Lookup result for %s:%s is %d", req.RemoteAddr, lookupReq.Port, port)
-	return json.NewEncoder(w).Encode(port)
+	logrus.Printf("Lookup result for %s:%s is %s %v", caller, port, resp.State, resp.Bindings)
+	return writeJSON(w, resp)
+}
+
+// SelfHandler returns the details of the calling container.
+// Method: GET
+// Path: /v1/self
+// Query: hostname, ip and mac hints. See LookupHandler.
+// Response: see discoverclient.ContainerInfo{}.
+func (h *Handlers) SelfHandler(w http.ResponseWriter, req *http.Request) error {
+	info, err := h.Backend.Self(queryCaller(req))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, info)
+}
+
+// ContainersHandler lists the running containers.
+// Method: GET
+// Path: /v1/containers
+// Response: list of discoverclient.ContainerInfo{}.
+func (h *Handlers) ContainersHandler(w http.ResponseWriter, req *http.Request) error {
+	infos, err := h.Backend.ListContainers()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, infos)
+}
+
+// HealthHandler reports the backend health, see Backend.Health.
+// Method: GET
+// Path: /v1/health
+// Response: see discoverclient.HealthResponse{}.
+func (h *Handlers) HealthHandler(w http.ResponseWriter, req *http.Request) error {
+	resp, err := h.Backend.Health()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, resp)
+}
+
+// VersionHandler reports the service and api versions.
+// Method: GET
+// Path: /v1/version
+func VersionHandler(w http.ResponseWriter, req *http.Request) error {
+	return writeJSON(w, map[string]string{"version": Version, "api": apiVersion})
 }
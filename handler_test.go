@@ -0,0 +1,25 @@
+package localdiscovery
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	for _, tc := range []struct {
+		remoteAddr, expect string
+	}{
+		{remoteAddr: "10.0.0.2:1234", expect: "10.0.0.2"},
+		{remoteAddr: "10.0.0.2", expect: "10.0.0.2"},
+		{remoteAddr: "[fd00::2]:1234", expect: "fd00::2"},
+		{remoteAddr: "fd00::2", expect: "fd00::2"},
+		{remoteAddr: "[::ffff:10.0.0.2]:1234", expect: "10.0.0.2"},
+		{remoteAddr: "[fe80::1%eth0]:1234", expect: "fe80::1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if got := remoteIP(req); got != tc.expect {
+			t.Fatalf("Unexpected remote ip for %s.\nExpected: %s\nGot:      %s", tc.remoteAddr, tc.expect, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package localdiscovery
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+)
+
+// TrustPolicy defines how much the identity hints sent by the caller are trusted.
+type TrustPolicy int
+
+// Trust policies.
+const (
+	// TrustRemote ignores the hints and only matches the connection remote address. Default.
+	TrustRemote TrustPolicy = iota
+	// TrustFallback matches the remote address first and falls back on the hints.
+	TrustFallback
+	// TrustHints matches the hints first and falls back on the remote address.
+	TrustHints
+)
+
+var trustPolicyNames = map[TrustPolicy]string{
+	TrustRemote:   "remote",
+	TrustFallback: "fallback",
+	TrustHints:    "hints",
+}
+
+// String implements the fmt.Stringer interface.
+func (p TrustPolicy) String() string {
+	if name, ok := trustPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("TrustPolicy(%d)", int(p))
+}
+
+// ParseTrustPolicy parses the given trust policy name: remote, fallback or hints.
+func ParseTrustPolicy(name string) (TrustPolicy, error) {
+	for p, n := range trustPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return TrustRemote, fmt.Errorf("unknown trust policy %q", name)
+}
+
+// Caller identifies the container issuing a lookup.
+type Caller struct {
+	RemoteIP string // IP of the connection.
+
+	// Identity hints sent by the caller.
+	Hostname string
+	IP       string
+	MAC      string
+}
+
+// String implements the fmt.Stringer interface.
+func (c Caller) String() string {
+	s := c.RemoteIP
+	if c.Hostname != "" || c.IP != "" || c.MAC != "" {
+		s += fmt.Sprintf(" (hostname: %q, ip: %q, mac: %q)", c.Hostname, c.IP, c.MAC)
+	}
+	return s
+}
+
+// matchHints looks up the container matching the caller hints.
+// The MAC address takes precedence over the IP which takes precedence over the hostname.
+// Fails with an ambiguous_caller API error when the MAC or IP hint matches several containers.
+func (c *containerCache) matchHints(caller Caller) (Match, bool, error) {
+	if caller.MAC != "" {
+		if m, ok, err := c.lookupMAC(caller.MAC); ok || err != nil {
+			return m, ok, err
+		}
+	}
+	if caller.IP != "" {
+		if m, ok, err := c.lookupIP(caller.IP, caller); ok || err != nil {
+			return m, ok, err
+		}
+	}
+	if caller.Hostname != "" {
+		m, n := c.lookupHostname(caller.Hostname)
+		if n == 1 {
+			return m, true, nil
+		}
+		if n > 1 {
+			logrus.WithField("hostname", caller.Hostname).Warnf("hostname matches %d containers, ignoring", n)
+		}
+	}
+	return Match{}, false, nil
+}
+
+// match looks up the container of the caller following the given trust policy.
+// Fails with an ambiguous_caller API error when the caller IP belongs to several docker endpoints,
+// see lookupIP.
+func (c *containerCache) match(caller Caller, policy TrustPolicy) (Match, bool, error) {
+	switch policy {
+	case TrustFallback:
+		if m, ok, err := c.lookupIP(caller.RemoteIP, caller); ok || err != nil {
+			return m, ok, err
+		}
+		return c.matchHints(caller)
+	case TrustHints:
+		if m, ok, err := c.matchHints(caller); ok || err != nil {
+			return m, ok, err
+		}
+	}
+	return c.lookupIP(caller.RemoteIP, caller)
+}
+
+// lookupMAC returns the container owning the given hardware address.
+// When the address is present on multiple networks of the container, the first network
+// in lexical order wins.
+// Returns an ambiguous_caller API error if several containers own it: docker derives
+// the default address from the IP, the containers sharing an IP on different docker
+// endpoints share their MAC address as well.
+func (c *containerCache) lookupMAC(mac string) (Match, bool, error) {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return Match{}, false, nil
+	}
+	var m matches
+	for _, cont := range c.list() {
+		if cont.NetworkSettings == nil {
+			continue
+		}
+		names := make([]string, 0, len(cont.NetworkSettings.Networks))
+		for name := range cont.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if strings.EqualFold(cont.NetworkSettings.Networks[name].MacAddress, hwAddr.String()) {
+				m = append(m, Match{Container: cont, Network: name})
+				break
+			}
+		}
+		if len(names) == 0 && strings.EqualFold(cont.NetworkSettings.MacAddress, hwAddr.String()) {
+			m = append(m, Match{Container: cont, Network: defaultNetwork})
+		}
+	}
+	switch len(m) {
+	case 0:
+		return Match{}, false, nil
+	case 1:
+		return m[0], true, nil
+	}
+	return Match{}, false, apiError(discoverclient.CodeAmbiguousCaller, "mac %s matches %d containers", hwAddr, len(m))
+}
+
+// lookupHostname returns the first container with the given hostname
+// along with the number of matching containers.
+func (c *containerCache) lookupHostname(hostname string) (Match, int) {
+	var (
+		m Match
+		n int
+	)
+	for _, cont := range c.list() {
+		if cont.Config == nil || cont.Config.Hostname != hostname {
+			continue
+		}
+		if n == 0 {
+			m = Match{Container: cont}
+		}
+		n++
+	}
+	return m, n
+}
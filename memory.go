@@ -0,0 +1,132 @@
+package localdiscovery
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// StaticContainer describes a container served by the MemoryBackend and StaticBackend.
+type StaticContainer struct {
+	ID       string            `json:"id" yaml:"id"`
+	Name     string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Hostname string            `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Image    string            `json:"image,omitempty" yaml:"image,omitempty"`
+	MAC      string            `json:"mac,omitempty" yaml:"mac,omitempty"`           // Hardware address on all the networks.
+	Networks map[string]string `json:"networks,omitempty" yaml:"networks,omitempty"` // IPv4 or IPv6 keyed by network name.
+	// Ports are the host bindings keyed by container port. ex: 80/tcp, 53/udp.
+	// A binding is a host port optionally prefixed by the host IP. ex: 8080, 127.0.0.1:8080.
+	// An empty list means the port is exposed but not published.
+	Ports  map[string][]string         `json:"ports,omitempty" yaml:"ports,omitempty"`
+	Health discoverclient.HealthStatus `json:"health,omitempty" yaml:"health,omitempty"`
+}
+
+// container converts the static container to its docker form, indexed by the cache.
+func (s StaticContainer) container() (*docker.Container, error) {
+	if s.ID == "" {
+		return nil, fmt.Errorf("missing container id")
+	}
+	cont := &docker.Container{
+		ID:     s.ID,
+		Image:  s.Image,
+		Config: &docker.Config{Hostname: s.Hostname},
+		State:  docker.State{Running: true},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: make(map[string]docker.ContainerNetwork, len(s.Networks)),
+			Ports:    make(map[docker.Port][]docker.PortBinding, len(s.Ports)),
+		},
+	}
+	cont.State.Health.Status = string(s.Health)
+	if s.Name != "" {
+		cont.Name = "/" + strings.TrimPrefix(s.Name, "/")
+	}
+	for name, addr := range s.Networks {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("container %s: invalid IP %q on network %s", s.ID, addr, name)
+		}
+		network := docker.ContainerNetwork{MacAddress: s.MAC}
+		if ip.To4() != nil {
+			network.IPAddress = ip.String()
+		} else {
+			network.GlobalIPv6Address = ip.String()
+		}
+		cont.NetworkSettings.Networks[name] = network
+	}
+	for port, bindings := range s.Ports {
+		port, err := normalizePort(port)
+		if err != nil {
+			return nil, fmt.Errorf("container %s: %s", s.ID, err)
+		}
+		list := []docker.PortBinding{}
+		for _, binding := range bindings {
+			hostIP, hostPort := "0.0.0.0", binding
+			if i := strings.LastIndex(binding, ":"); i != -1 {
+				hostIP, hostPort = strings.Trim(binding[:i], "[]"), binding[i+1:]
+			}
+			if n, err := strconv.Atoi(hostPort); err != nil || n <= 0 || n > 65535 {
+				return nil, fmt.Errorf("container %s: invalid binding %q of port %s", s.ID, binding, port)
+			}
+			list = append(list, docker.PortBinding{HostIP: hostIP, HostPort: hostPort})
+		}
+		cont.NetworkSettings.Ports[docker.Port(port)] = list
+	}
+	return cont, nil
+}
+
+// MemoryBackend is a Backend serving containers set programmatically.
+// Intended for the tests.
+type MemoryBackend struct {
+	cacheBackend
+}
+
+// NewMemoryBackend instantiates an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{cacheBackend{cache: newContainerCache()}}
+}
+
+// Set adds or replaces the given containers.
+func (m *MemoryBackend) Set(containers ...StaticContainer) error {
+	conts, err := staticContainers(containers)
+	if err != nil {
+		return err
+	}
+	for _, cont := range conts {
+		m.cache.set(cont)
+	}
+	return nil
+}
+
+// Remove drops the given container IDs.
+func (m *MemoryBackend) Remove(ids ...string) {
+	for _, id := range ids {
+		m.cache.remove(id)
+	}
+}
+
+// Replace discards all the containers and sets the given ones.
+func (m *MemoryBackend) Replace(containers ...StaticContainer) error {
+	conts, err := staticContainers(containers)
+	if err != nil {
+		return err
+	}
+	m.cache.replace(conts)
+	return nil
+}
+
+// staticContainers converts the given static containers to their docker form.
+func staticContainers(containers []StaticContainer) ([]*docker.Container, error) {
+	conts := make([]*docker.Container, 0, len(containers))
+	for _, s := range containers {
+		cont, err := s.container()
+		if err != nil {
+			return nil, err
+		}
+		conts = append(conts, cont)
+	}
+	return conts, nil
+}
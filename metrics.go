@@ -0,0 +1,353 @@
+package localdiscovery
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+)
+
+// defaultBuckets are the latency histogram buckets, in seconds.
+var defaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a metric family of the registry.
+type metric interface {
+	// write sends the family in the Prometheus text exposition format.
+	write(w io.Writer) error
+}
+
+// registry is a minimal Prometheus registry.
+// Supports labeled counters, labeled histograms and gauges computed on scrape.
+type registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// register adds the given metric to the registry.
+func (r *registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// write sends all the metrics in the Prometheus text exposition format.
+func (r *registry) write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricHeader returns the HELP and TYPE lines of a metric family.
+func metricHeader(name, help, typ string) string {
+	help = strings.Replace(strings.Replace(help, `\`, `\\`, -1), "\n", `\n`, -1)
+	return fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// formatLabels returns the label set of a sample. ex: {call="ping",le="0.5"}
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabel escapes the given label value.
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelKey joins the label values as a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// counterVec is a counter family partitioned by labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	series map[string][]string // Label values keyed by labelKey.
+}
+
+// newCounterVec registers a new counter family.
+func (r *registry) newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}, series: map[string][]string{}}
+	r.register(c)
+	return c
+}
+
+// inc increments the counter of the given label values.
+func (c *counterVec) inc(values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	c.values[key]++
+	c.series[key] = values
+	c.mu.Unlock()
+}
+
+// write implements the metric interface.
+func (c *counterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := metricHeader(c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		out += c.name + " 0\n"
+	}
+	for _, key := range sortedKeys(c.series) {
+		out += c.name + formatLabels(c.labels, c.series[key]) + " " + formatFloat(c.values[key]) + "\n"
+	}
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+// histogram is a single series of a histogramVec.
+type histogram struct {
+	values []string
+	counts []uint64 // Per bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram family partitioned by labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+// newHistogramVec registers a new histogram family with the default buckets.
+func (r *registry) newHistogramVec(name, help string, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: defaultBuckets, series: map[string]*histogram{}}
+	r.register(h)
+	return h
+}
+
+// observe records the given value for the given label values.
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// since records the duration elapsed since the given time, in seconds.
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+// write implements the metric interface.
+func (h *histogramVec) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := metricHeader(h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		bounds := append(append([]float64(nil), h.buckets...), math.Inf(+1))
+		for i, bound := range bounds {
+			if i < len(s.counts) {
+				cumulative += s.counts[i]
+			} else {
+				cumulative = s.count
+			}
+			values := append(append([]string(nil), s.values...), formatFloat(bound))
+			out += h.name + "_bucket" + formatLabels(labels, values) + " " + strconv.FormatUint(cumulative, 10) + "\n"
+		}
+		out += h.name + "_sum" + formatLabels(h.labels, s.values) + " " + formatFloat(s.sum) + "\n"
+		out += h.name + "_count" + formatLabels(h.labels, s.values) + " " + strconv.FormatUint(s.count, 10) + "\n"
+	}
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+// gaugeFunc is a gauge computed on scrape.
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+// newGaugeFunc registers a new gauge computed by the given function.
+func (r *registry) newGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+// write implements the metric interface.
+func (g *gaugeFunc) write(w io.Writer) error {
+	_, err := io.WriteString(w, metricHeader(g.name, g.help, "gauge")+g.name+" "+formatFloat(g.fn())+"\n")
+	return err
+}
+
+// sortedKeys returns the keys of the given map in lexical order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Lookup outcomes.
+const (
+	outcomeFound      = "found"
+	outcomeNotExposed = "not_exposed"
+	outcomeNotFound   = "not_found"
+	outcomeError      = "error"
+)
+
+// metrics are the DockerDiscovery metrics.
+// A nil *metrics records nothing.
+type metrics struct {
+	registry *registry
+
+	lookups         *counterVec
+	lookupDuration  *histogramVec
+	dockerDuration  *histogramVec
+	dockerErrors    *counterVec
+	eventReconnects *counterVec
+
+	mu             sync.Mutex
+	eventListeners int
+}
+
+// newMetrics instantiates the metrics of the given discovery.
+func newMetrics(d *DockerDiscovery) *metrics {
+	r := &registry{}
+	m := &metrics{
+		registry:        r,
+		lookups:         r.newCounterVec("localdiscovery_lookups_total", "Port lookups by outcome.", "outcome"),
+		lookupDuration:  r.newHistogramVec("localdiscovery_lookup_duration_seconds", "Port lookups latency."),
+		dockerDuration:  r.newHistogramVec("localdiscovery_docker_request_duration_seconds", "Docker API calls latency.", "endpoint", "call"),
+		dockerErrors:    r.newCounterVec("localdiscovery_docker_request_errors_total", "Failed docker API calls.", "endpoint", "call"),
+		eventReconnects: r.newCounterVec("localdiscovery_docker_event_reconnects_total", "Docker event stream reconnections.", "endpoint"),
+	}
+	r.newGaugeFunc("localdiscovery_cache_containers", "Running containers in the cache.", func() float64 {
+		return float64(d.cache.size())
+	})
+	r.newGaugeFunc("localdiscovery_cache_age_seconds", "Time since the last full cache reconciliation.", func() float64 {
+		updated := d.cache.lastUpdate()
+		if updated.IsZero() {
+			return 0
+		}
+		return time.Since(updated).Seconds()
+	})
+	r.newGaugeFunc("localdiscovery_docker_event_listeners", "Active docker event stream listeners.", func() float64 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return float64(m.eventListeners)
+	})
+	r.newGaugeFunc("localdiscovery_cache_watchers", "Active watchers of the container cache, see DockerDiscovery.Watch.", func() float64 {
+		return float64(d.cache.watchers())
+	})
+	return m
+}
+
+// lookup records a port lookup outcome and latency.
+func (m *metrics) lookup(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	outcome := outcomeFound
+	if err != nil {
+		outcome = outcomeError
+		if apiErr, ok := err.(*discoverclient.APIError); ok {
+			switch apiErr.Code {
+			case discoverclient.CodeNotExposed:
+				outcome = outcomeNotExposed
+			case discoverclient.CodeContainerNotFound:
+				outcome = outcomeNotFound
+			}
+		}
+	}
+	m.lookups.inc(outcome)
+	m.lookupDuration.since(start)
+}
+
+// dockerCall records a docker API call latency and failure for the given docker endpoint.
+func (m *metrics) dockerCall(endpoint, call string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.dockerDuration.since(start, endpoint, call)
+	if err != nil {
+		m.dockerErrors.inc(endpoint, call)
+	}
+}
+
+// eventListener records a docker event listener subscription (+1) or removal (-1).
+func (m *metrics) eventListener(delta int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.eventListeners += delta
+	m.mu.Unlock()
+}
+
+// eventReconnect records a docker event stream reconnection of the given docker endpoint.
+func (m *metrics) eventReconnect(endpoint string) {
+	if m == nil {
+		return
+	}
+	m.eventReconnects.inc(endpoint)
+}
+
+// MetricsHandler sends the metrics in the Prometheus text exposition format.
+// Method: GET
+func (d *DockerDiscovery) MetricsHandler(w http.ResponseWriter, req *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if d.metrics == nil {
+		return nil
+	}
+	return d.metrics.registry.write(w)
+}
@@ -0,0 +1,106 @@
+package localdiscovery
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	r := &registry{}
+	counter := r.newCounterVec("test_requests_total", "Requests by \"path\",\nwith a \\ in the help.", "path", "code")
+	r.newCounterVec("test_errors_total", "Unlabeled counter.")
+	histogram := r.newHistogramVec("test_duration_seconds", "Latency.", "call")
+	r.newGaugeFunc("test_gauge", "Computed gauge.", func() float64 { return 42 })
+
+	counter.inc(`/a"b`, "200")
+	counter.inc(`/a"b`, "200")
+	counter.inc("c\\d\ne", "500")
+	for _, v := range []float64{.0005, .001, .02, .02, 3, 20} {
+		histogram.observe(v, "ping")
+	}
+
+	expect := `# HELP test_requests_total Requests by "path",\nwith a \\ in the help.
+# TYPE test_requests_total counter
+test_requests_total{path="/a\"b",code="200"} 2
+test_requests_total{path="c\\d\ne",code="500"} 1
+# HELP test_errors_total Unlabeled counter.
+# TYPE test_errors_total counter
+test_errors_total 0
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{call="ping",le="0.001"} 2
+test_duration_seconds_bucket{call="ping",le="0.005"} 2
+test_duration_seconds_bucket{call="ping",le="0.01"} 2
+test_duration_seconds_bucket{call="ping",le="0.025"} 4
+test_duration_seconds_bucket{call="ping",le="0.05"} 4
+test_duration_seconds_bucket{call="ping",le="0.1"} 4
+test_duration_seconds_bucket{call="ping",le="0.25"} 4
+test_duration_seconds_bucket{call="ping",le="0.5"} 4
+test_duration_seconds_bucket{call="ping",le="1"} 4
+test_duration_seconds_bucket{call="ping",le="2.5"} 4
+test_duration_seconds_bucket{call="ping",le="5"} 5
+test_duration_seconds_bucket{call="ping",le="10"} 5
+test_duration_seconds_bucket{call="ping",le="+Inf"} 6
+test_duration_seconds_sum{call="ping"} 23.0415
+test_duration_seconds_count{call="ping"} 6
+# HELP test_gauge Computed gauge.
+# TYPE test_gauge gauge
+test_gauge 42
+`
+	buf := bytes.NewBuffer(nil)
+	if err := r.write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expect {
+		t.Fatalf("Unexpected exposition.\nExpected:\n%s\nGot:\n%s", expect, buf)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	client := newFakeClient(fakeContainer("a", "172.17.0.2"), fakeContainer("b", "172.17.0.3"))
+	discovery, err := NewDockerDiscoveryWithClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_ = discovery.Watch(ctx)
+
+	router := discovery.Router()
+	req := httptest.NewRequest("GET", selfPortsPath+"80", nil)
+	req.RemoteAddr = "172.17.0.2:1234"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", metricsPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d (%s)", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected content type: %s", ct)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE localdiscovery_lookups_total counter\n",
+		`localdiscovery_lookups_total{outcome="not_exposed"} 1` + "\n",
+		"# TYPE localdiscovery_lookup_duration_seconds histogram\n",
+		"localdiscovery_lookup_duration_seconds_count 1\n",
+		`localdiscovery_lookup_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		`localdiscovery_docker_request_duration_seconds_count{endpoint="",call="list_containers"} 1` + "\n",
+		"# TYPE localdiscovery_docker_request_errors_total counter\n",
+		"# TYPE localdiscovery_docker_event_reconnects_total counter\n",
+		"# TYPE localdiscovery_cache_containers gauge\nlocaldiscovery_cache_containers 2\n",
+		"# TYPE localdiscovery_cache_age_seconds gauge\n",
+		"# TYPE localdiscovery_cache_watchers gauge\nlocaldiscovery_cache_watchers 1\n",
+		"# TYPE localdiscovery_docker_event_listeners gauge\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Missing %q in metrics:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package localdiscovery
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies is a list of networks allowed to forward requests on behalf of the callers.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses the given comma separated list of CIDRs or IPs.
+// ex: 127.0.0.1,172.17.0.0/16,fd00::/8
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, elem := range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		if !strings.Contains(elem, "/") {
+			ip := net.ParseIP(elem)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", elem)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(elem)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", elem, err)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// Contains checks if the given IP belongs to a trusted proxy.
+func (p TrustedProxies) Contains(ip string) bool {
+	parsed := net.ParseIP(normalizeIP(ip))
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range p {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the addresses listed in the Forwarded header (RFC 7239)
+// or, if absent, in the X-Forwarded-For header. Closest proxy last.
+func forwardedFor(header http.Header) []string {
+	var addrs []string
+	for _, value := range header["Forwarded"] {
+		for _, elem := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+					continue
+				}
+				addr := strings.Trim(pair[4:], `"`)
+				// IPv6 are bracketed and may have a port.
+				if host, _, err := net.SplitHostPort(addr); err == nil {
+					addr = host
+				}
+				addrs = append(addrs, strings.Trim(addr, "[]"))
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs
+	}
+	for _, value := range header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(value, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	return addrs
+}
+
+// clientIP returns the IP of the original client of a request coming from a trusted proxy.
+// Walks the forwarded chain from the closest hop and returns the first untrusted address.
+// Returns an empty string when no forwarded address is present.
+func (p TrustedProxies) clientIP(header http.Header) string {
+	addrs := forwardedFor(header)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := normalizeIP(addrs[i])
+		if net.ParseIP(ip) == nil {
+			// Obfuscated or invalid identifier, stop here.
+			return ""
+		}
+		if i == 0 || !p.Contains(ip) {
+			return ip
+		}
+	}
+	return ""
+}
+
+// Handler rewrites the request remote address with the client IP taken from
+// the Forwarded or X-Forwarded-For headers when the request comes from a trusted proxy.
+func (p TrustedProxies) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p.Contains(remoteIP(req)) {
+			if ip := p.clientIP(req.Header); ip != "" {
+				req.RemoteAddr = net.JoinHostPort(ip, "0")
+			}
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
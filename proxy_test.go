@@ -0,0 +1,200 @@
+package localdiscovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies(" 127.0.0.1, 172.17.0.0/16,,fd00::/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expect := range map[string]bool{
+		"127.0.0.1":         true,
+		"127.0.0.2":         false,
+		"172.17.3.4":        true,
+		"::ffff:172.17.0.1": true,
+		"172.18.0.1":        false,
+		"fd00::2":           true,
+		"fe80::1%eth0":      false,
+		"::1":               true,
+		"nope":              false,
+	} {
+		if got := proxies.Contains(ip); got != expect {
+			t.Fatalf("Unexpected trust for %s.\nExpected: %t\nGot:      %t", ip, expect, got)
+		}
+	}
+	for _, list := range []string{"nope", "10.0.0.0/33", "10.0.0.1/"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Fatalf("Expected error for %q", list)
+		}
+	}
+}
+
+func TestTrustedProxiesHandler(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/24,fd00::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := proxies.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(remoteIP(req)))
+	}))
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		expect     string
+	}{
+		{name: "no header", remoteAddr: "10.0.0.1:1234", expect: "10.0.0.1"},
+		{name: "xff single", remoteAddr: "10.0.0.1:1234", header: http.Header{"X-Forwarded-For": {"172.17.0.2"}}, expect: "172.17.0.2"},
+		{name: "xff trusted hops", remoteAddr: "10.0.0.1:1234", header: http.Header{"X-Forwarded-For": {"172.17.0.2, 10.0.0.3", "10.0.0.2"}}, expect: "172.17.0.2"},
+		{name: "xff untrusted hop", remoteAddr: "10.0.0.1:1234", header: http.Header{"X-Forwarded-For": {"172.17.0.2, 192.0.2.1, 10.0.0.2"}}, expect: "192.0.2.1"},
+		{name: "xff all trusted", remoteAddr: "10.0.0.1:1234", header: http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, expect: "10.0.0.3"},
+		{name: "xff invalid", remoteAddr: "10.0.0.1:1234", header: http.Header{"X-Forwarded-For": {"172.17.0.2, unknown"}}, expect: "10.0.0.1"},
+		{name: "forwarded", remoteAddr: "10.0.0.1:1234", header: http.Header{"Forwarded": {`for=172.17.0.2;proto=http, For="[fd00::3]:4711"`}}, expect: "172.17.0.2"},
+		{name: "forwarded untrusted hop", remoteAddr: "10.0.0.1:1234", header: http.Header{"Forwarded": {`for=172.17.0.2, for="[2001:db8::1]:80";by=10.0.0.1`}}, expect: "2001:db8::1"},
+		{name: "forwarded obfuscated", remoteAddr: "10.0.0.1:1234", header: http.Header{"Forwarded": {"for=_hidden"}}, expect: "10.0.0.1"},
+		{name: "forwarded over xff", remoteAddr: "[fd00::1]:1234", header: http.Header{"Forwarded": {"for=172.17.0.2"}, "X-Forwarded-For": {"172.17.0.3"}}, expect: "172.17.0.2"},
+		{name: "untrusted peer xff", remoteAddr: "192.0.2.1:1234", header: http.Header{"X-Forwarded-For": {"172.17.0.2"}}, expect: "192.0.2.1"},
+		{name: "untrusted peer forwarded", remoteAddr: "192.0.2.1:1234", header: http.Header{"Forwarded": {"for=172.17.0.2"}}, expect: "192.0.2.1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for key, values := range tc.header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := w.Body.String(); got != tc.expect {
+			t.Fatalf("Unexpected client IP for %s.\nExpected: %s\nGot:      %s", tc.name, tc.expect, got)
+		}
+	}
+}
+
+// proxyV2Header builds a PROXY protocol v2 header.
+func proxyV2Header(verCmd, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// proxyV2Payload builds the address block of a PROXY protocol v2 header.
+func proxyV2Payload(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	payload := append(append([]byte{}, src...), dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, srcPort)
+	binary.BigEndian.PutUint16(ports[2:], dstPort)
+	return append(payload, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := proxyV2Payload(net.ParseIP("192.168.0.1").To4(), net.ParseIP("192.168.0.11").To4(), 56324, 443)
+	v6 := proxyV2Payload(net.ParseIP("fd00::2"), net.ParseIP("fd00::1"), 56324, 443)
+	badSignature := proxyV2Header(0x21, 0x11, v4)
+	badSignature[4] = 'X'
+
+	for _, tc := range []struct {
+		name   string
+		in     []byte
+		expect string // Expected address, empty for none.
+		fail   bool
+	}{
+		{name: "v1 tcp4", in: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET /"), expect: "192.168.0.1:56324"},
+		{name: "v1 tcp6", in: []byte("PROXY TCP6 fd00::2 fd00::1 56324 443\r\nGET /"), expect: "[fd00::2]:56324"},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\nGET /")},
+		{name: "v1 unknown with addresses", in: []byte("PROXY UNKNOWN fd00::2 fd00::1 56324 443\r\nGET /")},
+		{name: "v1 missing crlf", in: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\nGET /"), fail: true},
+		{name: "v1 too long", in: []byte("PROXY TCP6 " + strings.Repeat("0", 100) + " fd00::1 56324 443\r\n"), fail: true},
+		{name: "v1 invalid ip", in: []byte("PROXY TCP4 nope 192.168.0.11 56324 443\r\n"), fail: true},
+		{name: "v1 invalid port", in: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n"), fail: true},
+		{name: "v1 invalid protocol", in: []byte("PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n"), fail: true},
+		{name: "v2 local", in: proxyV2Header(0x20, 0x00, nil)},
+		{name: "v2 local with addresses", in: proxyV2Header(0x20, 0x11, v4)},
+		{name: "v2 inet", in: proxyV2Header(0x21, 0x11, v4), expect: "192.168.0.1:56324"},
+		{name: "v2 inet udp", in: proxyV2Header(0x21, 0x12, v4), expect: "192.168.0.1:56324"},
+		{name: "v2 inet6", in: proxyV2Header(0x21, 0x21, v6), expect: "[fd00::2]:56324"},
+		{name: "v2 inet6 with tlv", in: proxyV2Header(0x21, 0x21, append(v6, 0x04, 0x00, 0x01, 0x00)), expect: "[fd00::2]:56324"},
+		{name: "v2 unspec", in: proxyV2Header(0x21, 0x00, nil)},
+		{name: "v2 bad version", in: proxyV2Header(0x11, 0x11, v4), fail: true},
+		{name: "v2 truncated address block", in: proxyV2Header(0x21, 0x21, v4), fail: true},
+		{name: "v2 truncated payload", in: proxyV2Header(0x21, 0x11, v4)[:20], fail: true},
+		{name: "v2 bad signature", in: badSignature},
+		{name: "no header", in: []byte("GET / HTTP/1.1\r\n\r\n")},
+	} {
+		r := bufio.NewReader(bytes.NewReader(tc.in))
+		addr, err := readProxyHeader(r)
+		if tc.fail {
+			if err == nil {
+				t.Fatalf("Expected error for %s, got %v", tc.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", tc.name, err)
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.expect {
+			t.Fatalf("Unexpected address for %s.\nExpected: %q\nGot:      %q", tc.name, tc.expect, got)
+		}
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	trusted, err := ParseTrustedProxies("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		trusted TrustedProxies
+		header  string
+		expect  string // Expected remote IP.
+		body    string // Expected data after the header.
+	}{
+		{name: "trusted", trusted: trusted, header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", expect: "192.168.0.1", body: "hello"},
+		{name: "trusted without header", trusted: trusted, expect: "127.0.0.1", body: "hello"},
+		{name: "untrusted", header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", expect: "127.0.0.1", body: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nhello"},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := NewProxyProtoListener(l, tc.trusted)
+		go func(msg string) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(msg))
+			_ = conn.Close()
+		}(tc.header + "hello")
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil || host != tc.expect {
+			t.Fatalf("Unexpected remote address for %s.\nExpected: %s\nGot:      %s (%v)", tc.name, tc.expect, conn.RemoteAddr(), err)
+		}
+		body, err := ioutil.ReadAll(conn)
+		if err != nil || string(body) != tc.body {
+			t.Fatalf("Unexpected body for %s.\nExpected: %q\nGot:      %q (%v)", tc.name, tc.body, body, err)
+		}
+		_ = conn.Close()
+		_ = listener.Close()
+	}
+}
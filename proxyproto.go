@@ -0,0 +1,172 @@
+package localdiscovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// proxyHeaderTimeout is the maximum delay to receive the PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature is the PROXY protocol v2 header signature.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// NewProxyProtoListener wraps the given listener to support the HAProxy PROXY protocol v1 and v2.
+// The header is only parsed for connections coming from a trusted proxy,
+// the connection remote address is then the one of the original client.
+func NewProxyProtoListener(l net.Listener, trusted TrustedProxies) net.Listener {
+	return &proxyProtoListener{Listener: l, trusted: trusted}
+}
+
+type proxyProtoListener struct {
+	net.Listener
+	trusted TrustedProxies
+}
+
+// Accept implements the net.Listener interface.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || !l.trusted.Contains(host) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn parses the PROXY protocol header on first use.
+type proxyProtoConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// init reads the PROXY protocol header, if any.
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)) // Best effort.
+		defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()     // Best effort.
+
+		c.remoteAddr, c.err = readProxyHeader(c.reader)
+		if c.err != nil && c.err != io.EOF {
+			logrus.WithError(c.err).WithField("proxy", c.Conn.RemoteAddr()).Error("invalid PROXY protocol header")
+		}
+	})
+}
+
+// Read implements the net.Conn interface.
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr implements the net.Conn interface.
+// Returns the original client address when a PROXY protocol header is present.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header.
+// Returns a nil address when no header is present or when the proxy does not forward the address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Short reads are fine: the data is too small to be a header.
+	buf, err := r.Peek(len(proxyV2Signature))
+	if len(buf) == 0 && err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(buf, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	case bytes.Equal(buf, proxyV2Signature):
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil
+}
+
+// readProxyHeaderV1 parses the human readable header.
+// ex: PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	// The header is at most 107 bytes long.
+	if len(line) > 107 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(line))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 parses the binary header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command: health check from the proxy itself, keep the real address.
+	if verCmd&0xF == 0 {
+		return nil, nil
+	}
+	var ipLen int
+	switch family >> 4 {
+	case 1: // AF_INET.
+		ipLen = net.IPv4len
+	case 2: // AF_INET6.
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX.
+		return nil, nil
+	}
+	if length < 2*ipLen+4 {
+		return nil, errors.New("malformed PROXY v2 header")
+	}
+	ip := net.IP(payload[:ipLen])
+	port := int(binary.BigEndian.Uint16(payload[2*ipLen : 2*ipLen+2]))
+	if family&0xF == 2 { // SOCK_DGRAM.
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
@@ -0,0 +1,343 @@
+package localdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Registrator labels.
+const (
+	// ServiceLabel is the container label holding the service name to register.
+	ServiceLabel = "localdiscovery.service"
+	// PortLabel is the optional container label holding the service port. ex: 80 or 53/udp.
+	// When absent, only the IP is registered.
+	PortLabel = "localdiscovery.port"
+	// NetworkLabel is the optional container label selecting the network of the registered IP.
+	// When absent, the default bridge network is preferred, then the first network in lexical order.
+	NetworkLabel = "localdiscovery.network"
+)
+
+// registratorStateFile is the file of the discovery directory recording the endpoints
+// registered by the Registrator, keyed by service then container ID.
+// A dot file, like the lock and temporary files, so it is not mistaken for a service.
+const registratorStateFile = ".registrator.json"
+
+// Registrator writes the discovery files of the labeled running containers
+// and removes them when the containers stop.
+// Only the endpoints it registered are managed, they are recorded in registratorStateFile
+// so the discovery files keep the text format when possible.
+// Hand written discovery files and endpoints are left untouched,
+// unless identical to the endpoint of a labeled container.
+type Registrator struct {
+	// ExcludeUnhealthy skips the containers with a healthcheck which are not healthy yet or anymore.
+	// Must be set before Run.
+	ExcludeUnhealthy bool
+
+	discovery *DockerDiscovery
+	dir       string
+
+	owned map[string]map[string]discoverclient.Endpoint // Registered endpoints, nil until loaded.
+}
+
+// NewRegistrator instantiates a new Registrator writing in the given discovery directory.
+// Call Run to start the registration.
+func NewRegistrator(discovery *DockerDiscovery, discoveryPath string) *Registrator {
+	return &Registrator{
+		discovery: discovery,
+		dir:       discoveryPath,
+	}
+}
+
+// Run synchronizes the discovery files with the running containers upon each cache update.
+// Stale endpoints of containers not running anymore are removed right away.
+// Blocks until stopChan is closed.
+func (r *Registrator) Run(stopChan <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := r.discovery.Watch(ctx)
+
+	r.sync()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-changes:
+			r.sync()
+		}
+	}
+}
+
+// sync registers the endpoints of the labeled containers and deregisters the stale ones.
+func (r *Registrator) sync() {
+	if r.owned == nil {
+		owned, err := r.loadState()
+		if err != nil {
+			logrus.WithError(err).WithField("path", r.dir).Error("error loading the registrator state")
+			return
+		}
+		r.owned = owned
+	}
+
+	// Endpoints keyed by service then container ID.
+	expected := map[string]map[string]discoverclient.Endpoint{}
+	for _, cont := range r.discovery.cache.list() {
+		if r.ExcludeUnhealthy && !isHealthy(containerHealth(cont)) {
+			continue
+		}
+		service, endpoint, ok, err := registratorEndpoint(cont)
+		if err != nil {
+			logrus.WithError(err).WithField("container", cont.ID).Warn("invalid registrator labels, skipping")
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if expected[service] == nil {
+			expected[service] = map[string]discoverclient.Endpoint{}
+		}
+		expected[service][cont.ID] = endpoint
+	}
+
+	services := map[string]struct{}{}
+	for service := range expected {
+		services[service] = struct{}{}
+	}
+	for service := range r.owned {
+		services[service] = struct{}{}
+	}
+	for service := range services {
+		if err := r.syncService(service, expected[service]); err != nil {
+			logrus.WithError(err).WithField("service", service).Error("error registering service")
+		}
+	}
+}
+
+// syncService updates the given service discovery file to match the expected endpoints, keyed by container ID.
+func (r *Registrator) syncService(service string, expected map[string]discoverclient.Endpoint) error {
+	owned := r.owned[service]
+	current, err := discoverclient.LookupLocalService(service, r.dir)
+	if err != nil && !discoverclient.IsMissingService(err) && !discoverclient.IsInvalidService(err) {
+		return err
+	}
+	// An invalid file is rewritten by the registration, without its invalid entries.
+
+	// The endpoints of the stopped or changed containers, unless still expected for another container.
+	var stale []discoverclient.Endpoint
+	for id, endpoint := range owned {
+		if want, ok := expected[id]; ok && sameEndpoint(want, endpoint) {
+			continue
+		}
+		if !expectsEndpoint(expected, endpoint) {
+			stale = append(stale, endpoint)
+		}
+	}
+	var missing []discoverclient.Endpoint
+	for _, endpoint := range expected {
+		if !containsEndpoint(current, endpoint) {
+			missing = append(missing, endpoint)
+		}
+	}
+
+	if len(missing) > 0 {
+		// Record the new endpoints first so they are cleaned up even if we stop right after.
+		pending := map[string]discoverclient.Endpoint{}
+		for id, endpoint := range owned {
+			pending[id] = endpoint
+		}
+		for id, endpoint := range expected {
+			pending[id] = endpoint
+		}
+		if err := r.setOwned(service, pending); err != nil {
+			return err
+		}
+		if err := discoverclient.RegisterLocalService(service, r.dir, missing...); err != nil {
+			return err
+		}
+		for _, endpoint := range missing {
+			logrus.WithField("service", service).WithField("endpoint", endpoint.String()).Info("endpoint registered")
+		}
+	}
+	if len(stale) > 0 {
+		if err := discoverclient.DeregisterLocalService(service, r.dir, stale...); err != nil {
+			return err
+		}
+		for _, endpoint := range stale {
+			logrus.WithField("service", service).WithField("endpoint", endpoint.String()).Info("endpoint deregistered")
+		}
+	}
+	return r.setOwned(service, expected)
+}
+
+// setOwned records the endpoints registered for the given service and saves the state if it changed.
+func (r *Registrator) setOwned(service string, endpoints map[string]discoverclient.Endpoint) error {
+	if reflect.DeepEqual(r.owned[service], endpoints) || (len(r.owned[service]) == 0 && len(endpoints) == 0) {
+		return nil
+	}
+	owned := make(map[string]map[string]discoverclient.Endpoint, len(r.owned))
+	for svc, endpoints := range r.owned {
+		owned[svc] = endpoints
+	}
+	if len(endpoints) == 0 {
+		delete(owned, service)
+	} else {
+		owned[service] = endpoints
+	}
+	if err := r.saveState(owned); err != nil {
+		return err
+	}
+	r.owned = owned
+	return nil
+}
+
+// loadState reads the registered endpoints from the state file. Empty if the file is not present.
+func (r *Registrator) loadState() (map[string]map[string]discoverclient.Endpoint, error) {
+	owned := map[string]map[string]discoverclient.Endpoint{}
+	buf, err := ioutil.ReadFile(filepath.Join(r.dir, registratorStateFile))
+	if os.IsNotExist(err) {
+		return owned, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &owned); err != nil {
+		return nil, fmt.Errorf("invalid registrator state %s: %s", registratorStateFile, err)
+	}
+	return owned, nil
+}
+
+// saveState replaces the state file with the given registered endpoints, or removes it when empty.
+func (r *Registrator) saveState(owned map[string]map[string]discoverclient.Endpoint) error {
+	pth := filepath.Join(r.dir, registratorStateFile)
+	if len(owned) == 0 {
+		if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	buf, err := json.MarshalIndent(owned, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(r.dir, registratorStateFile+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(buf, '\n')); err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close() // Best effort.
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), pth)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name()) // Best effort.
+	}
+	return err
+}
+
+// containsEndpoint checks if the given endpoints contain the given one.
+func containsEndpoint(endpoints []discoverclient.Endpoint, endpoint discoverclient.Endpoint) bool {
+	for _, elem := range endpoints {
+		if sameEndpoint(elem, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// expectsEndpoint checks if the given endpoint is expected for any container.
+func expectsEndpoint(expected map[string]discoverclient.Endpoint, endpoint discoverclient.Endpoint) bool {
+	for _, elem := range expected {
+		if sameEndpoint(elem, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameEndpoint checks if the given endpoints have the same address, port and protocol.
+func sameEndpoint(a, b discoverclient.Endpoint) bool {
+	return a.Address == b.Address && a.Port == b.Port && a.Protocol == b.Protocol
+}
+
+// registratorEndpoint builds the endpoint of the given container from its labels.
+// Returns false if the container is not labeled.
+func registratorEndpoint(cont *docker.Container) (string, discoverclient.Endpoint, bool, error) {
+	if cont.Config == nil || cont.Config.Labels[ServiceLabel] == "" {
+		return "", discoverclient.Endpoint{}, false, nil
+	}
+	labels := cont.Config.Labels
+	service := labels[ServiceLabel]
+
+	ip := registratorIP(containerIPs(cont), labels[NetworkLabel])
+	if ip == "" {
+		return "", discoverclient.Endpoint{}, false, fmt.Errorf("no IP found for service %q", service)
+	}
+	endpoint := discoverclient.Endpoint{Address: ip}
+	if port := labels[PortLabel]; port != "" {
+		port, err := normalizePort(port)
+		if err != nil {
+			return "", discoverclient.Endpoint{}, false, err
+		}
+		p := docker.Port(port)
+		endpoint.Port, _ = strconv.Atoi(p.Port()) // Validated by normalizePort.
+		if p.Proto() != "tcp" {
+			// tcp is implied, keeps the text format readable by LookupLocalServiceIP.
+			endpoint.Protocol = p.Proto()
+		}
+	}
+	return service, endpoint, true, nil
+}
+
+// registratorIP selects the IP to register among the given ones.
+// IPv4 are preferred over IPv6.
+func registratorIP(ips []networkIP, network string) string {
+	sort.Sort(networkIPs(ips))
+	var candidates []networkIP
+	for _, addr := range ips {
+		if network == "" || addr.Network == network {
+			candidates = append(candidates, addr)
+		}
+	}
+	if network == "" {
+		for _, addr := range candidates {
+			if addr.Network == defaultNetwork && !strings.Contains(addr.IP, ":") {
+				return addr.IP
+			}
+		}
+	}
+	for _, addr := range candidates {
+		if !strings.Contains(addr.IP, ":") {
+			return addr.IP
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0].IP
+	}
+	return ""
+}
+
+// networkIPs sorts the IPs by network name then IP.
+type networkIPs []networkIP
+
+func (n networkIPs) Len() int      { return len(n) }
+func (n networkIPs) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n networkIPs) Less(i, j int) bool {
+	if n[i].Network != n[j].Network {
+		return n[i].Network < n[j].Network
+	}
+	return n[i].IP < n[j].IP
+}
@@ -0,0 +1,267 @@
+package localdiscovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// labeledContainer returns a running container registering the given service and port.
+func labeledContainer(id, ip, service, port string) *docker.Container {
+	cont := fakeContainer(id, ip)
+	cont.Config.Labels = map[string]string{ServiceLabel: service}
+	if port != "" {
+		cont.Config.Labels[PortLabel] = port
+	}
+	return cont
+}
+
+// readTestFile returns the content of the given file, empty if missing.
+func readTestFile(t *testing.T, pth string) string {
+	buf, err := ioutil.ReadFile(pth)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestRegistratorSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Hand written files and entries.
+	if err := ioutil.WriteFile(filepath.Join(dir, "web"), []byte("10.0.0.2:80\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "db"), []byte("10.0.0.3:5432\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken"), []byte("nope\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeClient(
+		labeledContainer("a", "172.17.0.2", "db", "5432"),
+		labeledContainer("b", "172.17.0.3", "dns", "53/udp"),
+		labeledContainer("c", "172.17.0.4", "cache", ""),
+		fakeContainer("d", "172.17.0.5"),
+	)
+	discovery, err := NewDockerDiscoveryWithClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+	daemon := discovery.daemons[0]
+	registrator := NewRegistrator(discovery, dir)
+
+	expectFile := func(service, expect string) {
+		if got := readTestFile(t, filepath.Join(dir, service)); got != expect {
+			t.Fatalf("Unexpected %s discovery file.\nExpected: %q\nGot:      %q", service, expect, got)
+		}
+	}
+
+	// Add, in the text format when possible.
+	registrator.sync()
+	expectFile("db", "10.0.0.3:5432\n172.17.0.2:5432\n")
+	expectFile("cache", "172.17.0.4\n")
+	expectFile("web", "10.0.0.2:80\n")
+	expectFile("broken", "nope\n")
+	if ip, err := discoverclient.LookupLocalServiceIP("cache", dir); err != nil || ip != "172.17.0.4" {
+		t.Fatalf("Unexpected cache address: %s (%v)", ip, err)
+	}
+	if endpoints, err := discoverclient.LookupLocalService("dns", dir); err != nil || len(endpoints) != 1 ||
+		endpoints[0].String() != "172.17.0.3:53" || endpoints[0].Protocol != "udp" || len(endpoints[0].Tags) != 0 {
+		t.Fatalf("Unexpected dns endpoints: %+v (%v)", endpoints, err)
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else {
+		for _, fi := range files {
+			if fi.Name() == "d" {
+				t.Fatal("Unexpected discovery file for the unlabeled container")
+			}
+		}
+	}
+
+	// Idempotent.
+	registrator.sync()
+	expectFile("db", "10.0.0.3:5432\n172.17.0.2:5432\n")
+
+	// Update.
+	client.set(labeledContainer("a", "172.17.0.6", "db", "5432"))
+	daemon.handleEvent(&docker.APIEvents{Type: "network", Action: "connect", Actor: docker.APIActor{ID: "custom", Attributes: map[string]string{"container": "a"}}})
+	registrator.sync()
+	expectFile("db", "10.0.0.3:5432\n172.17.0.6:5432\n")
+
+	// Removal, the hand written entries and files stay.
+	for _, id := range []string{"a", "c"} {
+		daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: id}})
+	}
+	registrator.sync()
+	expectFile("db", "10.0.0.3:5432\n")
+	expectFile("cache", "")
+	expectFile("web", "10.0.0.2:80\n")
+
+	// The state survives a restart: the endpoints of the containers stopped meanwhile are removed.
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "b"}})
+	NewRegistrator(discovery, dir).sync()
+	expectFile("dns", "")
+	if state := readTestFile(t, filepath.Join(dir, registratorStateFile)); state != "" {
+		t.Fatalf("Unexpected registrator state: %s", state)
+	}
+
+	// Endpoints identical to a hand written one are adopted.
+	client.set(labeledContainer("e", "10.0.0.2", "web", "80"))
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "e"}})
+	registrator = NewRegistrator(discovery, dir)
+	registrator.sync()
+	expectFile("web", "10.0.0.2:80\n")
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "e"}})
+	registrator.sync()
+	expectFile("web", "")
+
+	// Corrupt files are rewritten without their invalid entries.
+	if err := ioutil.WriteFile(filepath.Join(dir, "web"), []byte("10.0.0.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client.set(labeledContainer("f", "172.17.0.7", "web", "80"))
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "f"}})
+	registrator.sync()
+	expectFile("web", "172.17.0.7:80\n")
+
+	// Invalid state.
+	if err := ioutil.WriteFile(filepath.Join(dir, registratorStateFile), []byte("nope"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRegistrator(discovery, dir).loadState(); err == nil {
+		t.Fatal("Expected error for an invalid state")
+	}
+}
+
+func TestRegistratorEndpoint(t *testing.T) {
+	dualStack := fakeContainer("a", "172.17.0.2")
+	dualStack.NetworkSettings.Networks = map[string]docker.ContainerNetwork{
+		"bridge":  {IPAddress: "172.17.0.2", GlobalIPv6Address: "fd00::2"},
+		"backend": {IPAddress: "10.0.0.2"},
+		"v6only":  {GlobalIPv6Address: "fd00:1::2"},
+	}
+
+	for _, tc := range []struct {
+		labels  map[string]string
+		service string
+		expect  discoverclient.Endpoint
+		skip    bool
+		fail    bool
+	}{
+		{skip: true},
+		{labels: map[string]string{PortLabel: "80"}, skip: true},
+		{labels: map[string]string{ServiceLabel: "web"}, service: "web", expect: discoverclient.Endpoint{Address: "172.17.0.2"}},
+		{labels: map[string]string{ServiceLabel: "web", PortLabel: "80/tcp"}, service: "web", expect: discoverclient.Endpoint{Address: "172.17.0.2", Port: 80}},
+		{labels: map[string]string{ServiceLabel: "dns", PortLabel: "53/udp"}, service: "dns", expect: discoverclient.Endpoint{Address: "172.17.0.2", Port: 53, Protocol: "udp"}},
+		{labels: map[string]string{ServiceLabel: "web", NetworkLabel: "backend"}, service: "web", expect: discoverclient.Endpoint{Address: "10.0.0.2"}},
+		{labels: map[string]string{ServiceLabel: "web", NetworkLabel: "v6only"}, service: "web", expect: discoverclient.Endpoint{Address: "fd00:1::2"}},
+		{labels: map[string]string{ServiceLabel: "web", NetworkLabel: "nope"}, fail: true},
+		{labels: map[string]string{ServiceLabel: "web", PortLabel: "http"}, fail: true},
+	} {
+		cont := *dualStack
+		config := *dualStack.Config
+		config.Labels = tc.labels
+		cont.Config = &config
+		service, endpoint, ok, err := registratorEndpoint(&cont)
+		if tc.fail {
+			if err == nil {
+				t.Fatalf("Expected error for %v, got %+v", tc.labels, endpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", tc.labels, err)
+		}
+		if ok == tc.skip || service != tc.service || !sameEndpoint(endpoint, tc.expect) || len(endpoint.Tags) != 0 {
+			t.Fatalf("Unexpected endpoint for %v: %s %+v (%t)", tc.labels, service, endpoint, ok)
+		}
+	}
+}
+
+func TestRegistratorIP(t *testing.T) {
+	for _, tc := range []struct {
+		ips     []networkIP
+		network string
+		expect  string
+	}{
+		{expect: ""},
+		{ips: []networkIP{{Network: "z", IP: "10.0.0.2"}, {Network: "a", IP: "10.0.1.2"}}, expect: "10.0.1.2"},
+		{ips: []networkIP{{Network: "a", IP: "10.0.1.2"}, {Network: defaultNetwork, IP: "172.17.0.2"}}, expect: "172.17.0.2"},
+		{ips: []networkIP{{Network: defaultNetwork, IP: "fd00::2"}, {Network: "a", IP: "10.0.1.2"}}, expect: "10.0.1.2"},
+		{ips: []networkIP{{Network: "a", IP: "fd00::2"}, {Network: "a", IP: "10.0.1.2"}}, network: "a", expect: "10.0.1.2"},
+		{ips: []networkIP{{Network: "a", IP: "fd00::2"}, {Network: "b", IP: "10.0.1.2"}}, network: "a", expect: "fd00::2"},
+		{ips: []networkIP{{Network: "a", IP: "10.0.1.2"}}, network: "b", expect: ""},
+	} {
+		if got := registratorIP(tc.ips, tc.network); got != tc.expect {
+			t.Fatalf("Unexpected IP for %v in %q.\nExpected: %s\nGot:      %s", tc.ips, tc.network, tc.expect, got)
+		}
+	}
+}
+
+func TestRegistratorExcludeUnhealthy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	withHealth := func(id, ip, health string) *docker.Container {
+		cont := labeledContainer(id, ip, "web", "80")
+		cont.State.Health.Status = health
+		return cont
+	}
+	client := newFakeClient(
+		withHealth("a", "172.17.0.2", "healthy"),
+		withHealth("b", "172.17.0.3", "unhealthy"),
+		withHealth("c", "172.17.0.4", "starting"),
+		withHealth("d", "172.17.0.5", ""),
+	)
+	discovery, err := NewDockerDiscoveryWithClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+	registrator := NewRegistrator(discovery, dir)
+	registrator.ExcludeUnhealthy = true
+
+	// Sorted, the registration order is not deterministic.
+	expectEndpoints := func(expect ...string) {
+		endpoints, err := discoverclient.LookupLocalService("web", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, endpoint := range endpoints {
+			got = append(got, endpoint.String())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("Unexpected endpoints.\nExpected: %v\nGot:      %v", expect, got)
+		}
+	}
+	registrator.sync()
+	expectEndpoints("172.17.0.2:80", "172.17.0.5:80")
+
+	// Registered once healthy, removed once unhealthy.
+	daemon := discovery.daemons[0]
+	client.set(withHealth("c", "172.17.0.4", "healthy"))
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "health_status: healthy", Actor: docker.APIActor{ID: "c"}})
+	client.set(withHealth("a", "172.17.0.2", "unhealthy"))
+	daemon.handleEvent(&docker.APIEvents{Type: "container", Action: "health_status: unhealthy", Actor: docker.APIActor{ID: "a"}})
+	registrator.sync()
+	expectEndpoints("172.17.0.4:80", "172.17.0.5:80")
+}
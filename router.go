@@ -0,0 +1,74 @@
+package localdiscovery
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	"github.com/creack/ehttp"
+)
+
+// API routes.
+const (
+	apiVersion     = "v1"
+	selfPath       = "/v1/self"
+	selfPortsPath  = "/v1/self/ports/"
+	containersPath = "/v1/containers"
+	healthPath     = "/v1/health"
+	versionPath    = "/v1/version"
+	metricsPath    = "/metrics"
+)
+
+// methods restricts the handler to the given http methods.
+// Other methods yield 405 Method Not Allowed.
+func methods(handler ehttp.HandlerFunc, allowed ...string) ehttp.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		for _, method := range allowed {
+			if req.Method == method {
+				return handler(w, req)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		return apiError(discoverclient.CodeMethodNotAllowed, "method %s not allowed on %s", req.Method, req.URL.Path)
+	}
+}
+
+// metricsBackend is implemented by the backends exposing Prometheus metrics.
+type metricsBackend interface {
+	MetricsHandler(w http.ResponseWriter, req *http.Request) error
+}
+
+// NewRouter returns the http handler serving the discover API on top of the given backend.
+//   - GET  /v1/self/ports/{port}: lookup the given port for the caller.
+//   - GET  /v1/self:              details of the caller container.
+//   - GET  /v1/containers:        list of the running containers.
+//   - GET  /v1/health:            service health.
+//   - GET  /v1/version:           service version.
+//   - GET  /metrics:              Prometheus metrics, if supported by the backend.
+//   - POST /:                     legacy lookup, see LookupHandler.
+func NewRouter(backend Backend) http.Handler {
+	h := NewHandlers(backend)
+	mux := ehttp.NewServeMux(sendError, "application/json; charset=utf-8", true, nil)
+
+	mux.HandleFunc(selfPortsPath, apiHandler(methods(h.SelfPortHandler, "GET")))
+	mux.HandleFunc(selfPath, apiHandler(methods(h.SelfHandler, "GET")))
+	mux.HandleFunc(containersPath, apiHandler(methods(h.ContainersHandler, "GET")))
+	mux.HandleFunc(healthPath, apiHandler(methods(h.HealthHandler, "GET")))
+	mux.HandleFunc(versionPath, apiHandler(methods(VersionHandler, "GET")))
+	if m, ok := backend.(metricsBackend); ok {
+		mux.HandleFunc(metricsPath, apiHandler(methods(m.MetricsHandler, "GET")))
+	}
+	// Backward compatibility with the pre-v1 clients posting on any path.
+	mux.HandleFunc("/", apiHandler(func(w http.ResponseWriter, req *http.Request) error {
+		if req.URL.Path != "/" && (req.Method != "POST" || strings.HasPrefix(req.URL.Path, "/v1/")) {
+			return apiError(discoverclient.CodeNotFound, "%s not found", req.URL.Path)
+		}
+		return methods(h.LookupHandler, "POST")(w, req)
+	}))
+	return mux
+}
+
+// Router returns the http handler serving the discover API for docker. See NewRouter.
+func (d *DockerDiscovery) Router() http.Handler {
+	return NewRouter(d)
+}
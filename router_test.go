@@ -0,0 +1,79 @@
+package localdiscovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+)
+
+func TestRouterRoutes(t *testing.T) {
+	backend := NewMemoryBackend()
+	if err := backend.Set(StaticContainer{
+		ID:       "web",
+		Networks: map[string]string{"bridge": "192.0.2.1"},
+		Ports:    map[string][]string{"80": {"32768"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(backend)
+
+	legacy, err := json.Marshal(discoverclient.LookupRequest{Port: "80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		body         []byte
+		code         int
+		errCode      discoverclient.ErrorCode // Expected error code, if any.
+		allow        string                   // Expected Allow header, if any.
+		port         int                      // Expected legacy port, if any.
+	}{
+		{method: "GET", path: "/v1/unknown", code: http.StatusNotFound, errCode: discoverclient.CodeNotFound},
+		{method: "POST", path: "/v1/unknown", body: legacy, code: http.StatusNotFound, errCode: discoverclient.CodeNotFound},
+		{method: "GET", path: "/lookup", code: http.StatusNotFound, errCode: discoverclient.CodeNotFound},
+		{method: "POST", path: "/v1/self/ports/80", code: http.StatusMethodNotAllowed, errCode: discoverclient.CodeMethodNotAllowed, allow: "GET"},
+		{method: "DELETE", path: "/v1/containers", code: http.StatusMethodNotAllowed, errCode: discoverclient.CodeMethodNotAllowed, allow: "GET"},
+		{method: "GET", path: "/", code: http.StatusMethodNotAllowed, errCode: discoverclient.CodeMethodNotAllowed, allow: "POST"},
+		{method: "POST", path: "/", body: legacy, code: http.StatusOK, port: 32768},
+		{method: "POST", path: "/lookup", body: legacy, code: http.StatusOK, port: 32768},
+		{method: "POST", path: "/any/legacy/path", body: legacy, code: http.StatusOK, port: 32768},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, bytes.NewReader(tc.body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tc.code {
+			t.Fatalf("Unexpected status code for %s %s.\nExpected: %d\nGot:      %d", tc.method, tc.path, tc.code, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != tc.allow {
+			t.Fatalf("Unexpected Allow header for %s %s.\nExpected: %q\nGot:      %q", tc.method, tc.path, tc.allow, allow)
+		}
+		if tc.code != http.StatusOK {
+			var resp discoverclient.ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("Invalid error response for %s %s: %s", tc.method, tc.path, err)
+			}
+			if resp.Error == nil || resp.Error.Code != tc.errCode {
+				t.Fatalf("Unexpected error code for %s %s.\nExpected: %s\nGot:      %+v", tc.method, tc.path, tc.errCode, resp.Error)
+			}
+			continue
+		}
+		// The legacy lookup answers with a bare int.
+		body := strings.TrimSpace(w.Body.String())
+		var port int
+		if err := json.Unmarshal([]byte(body), &port); err != nil {
+			t.Fatalf("Unexpected legacy response for %s %s: %q", tc.method, tc.path, body)
+		}
+		if port != tc.port {
+			t.Fatalf("Unexpected legacy port for %s %s.\nExpected: %d\nGot:      %d", tc.method, tc.path, tc.port, port)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package localdiscovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// staticFile is the content of the StaticBackend mapping file.
+type staticFile struct {
+	Containers []StaticContainer `json:"containers" yaml:"containers"`
+}
+
+// StaticBackend is a Backend serving the containers of a JSON or YAML mapping file.
+// Intended for the hosts without docker and the offline demos. ex:
+//   containers:
+//     - id: web
+//       hostname: web
+//       networks: {bridge: 172.17.0.2}
+//       ports: {80/tcp: ["32768"], 443/tcp: []}
+type StaticBackend struct {
+	cacheBackend
+
+	path string
+}
+
+// NewStaticBackend instantiates a new StaticBackend and loads the given mapping file.
+// The file is parsed as YAML when its extension is .yaml or .yml, JSON otherwise.
+func NewStaticBackend(path string) (*StaticBackend, error) {
+	s := &StaticBackend{
+		cacheBackend: cacheBackend{cache: newContainerCache()},
+		path:         path,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the mapping file again and replaces the containers.
+// The containers are kept as is if the file is invalid.
+func (s *StaticBackend) Reload() error {
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var file staticFile
+	switch strings.ToLower(filepath.Ext(s.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &file)
+	default:
+		err = json.Unmarshal(buf, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid mapping file %s: %s", s.path, err)
+	}
+	conts, err := staticContainers(file.Containers)
+	if err != nil {
+		return fmt.Errorf("invalid mapping file %s: %s", s.path, err)
+	}
+	s.cache.replace(conts)
+	return nil
+}
@@ -0,0 +1,140 @@
+package localdiscovery
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// swarmServiceLabel is the label set by docker on the swarm task containers.
+const swarmServiceLabel = "com.docker.swarm.service.id"
+
+// taskServiceIDs returns the swarm service ID of the given task containers, keyed by container ID.
+// The containers are identified by their label, or via the task list
+// for the daemons not labeling them. Standalone containers are omitted.
+func (d *dockerDaemon) taskServiceIDs(conts []*docker.Container, listTasks bool) map[string]string {
+	ids := map[string]string{}
+	var unlabeled []*docker.Container
+	for _, cont := range conts {
+		if cont.Config != nil && cont.Config.Labels[swarmServiceLabel] != "" {
+			ids[cont.ID] = cont.Config.Labels[swarmServiceLabel]
+			continue
+		}
+		unlabeled = append(unlabeled, cont)
+	}
+	if len(unlabeled) == 0 || !listTasks {
+		return ids
+	}
+
+	start := time.Now()
+	tasks, err := d.client.ListTasks(docker.ListTasksOptions{})
+	d.dockerCall("list_tasks", start, err)
+	if err != nil {
+		// Expected when the node is not a swarm manager.
+		d.log().WithError(err).Debug("unable to list the swarm tasks")
+		atomic.StoreInt32(&d.swarmManager, 0)
+		return ids
+	}
+	atomic.StoreInt32(&d.swarmManager, 1)
+	byContainer := make(map[string]string, len(tasks))
+	for _, task := range tasks {
+		if id := task.Status.ContainerStatus.ContainerID; id != "" {
+			byContainer[id] = task.ServiceID
+		}
+	}
+	for _, cont := range unlabeled {
+		if id, ok := byContainer[cont.ID]; ok {
+			ids[cont.ID] = id
+		}
+	}
+	return ids
+}
+
+// taskServices inspects the swarm services of the given task containers, keyed by container ID.
+// Services which cannot be inspected are omitted, the tasks are then served as standalone containers.
+func (d *dockerDaemon) taskServices(conts []*docker.Container, listTasks bool) map[string]*swarm.Service {
+	services := map[string]*swarm.Service{}
+	inspected := map[string]*swarm.Service{} // Keyed by service ID.
+	for contID, id := range d.taskServiceIDs(conts, listTasks) {
+		svc, ok := inspected[id]
+		if !ok {
+			start := time.Now()
+			var err error
+			svc, err = d.client.InspectService(id)
+			d.dockerCall("inspect_service", start, err)
+			if err != nil {
+				// The service endpoints are only available via the managers.
+				d.log().WithError(err).WithField("service", id).Debug("unable to inspect the swarm service")
+			}
+			inspected[id] = svc
+		}
+		if svc != nil {
+			services[contID] = svc
+		}
+	}
+	return services
+}
+
+// taskService returns the swarm service of the given container, nil if it is not a swarm task.
+func (d *dockerDaemon) taskService(cont *docker.Container) *swarm.Service {
+	return d.taskServices([]*docker.Container{cont}, atomic.LoadInt32(&d.swarmManager) == 1)[cont.ID]
+}
+
+// servicePorts returns the ports of the given service matching the given container port.
+// The port is expected to have the protocol suffix.
+func servicePorts(svc *swarm.Service, port string) []swarm.PortConfig {
+	if svc == nil {
+		return nil
+	}
+	var ports []swarm.PortConfig
+	for _, config := range svc.Endpoint.Ports {
+		if portConfigName(config) == port {
+			ports = append(ports, config)
+		}
+	}
+	return ports
+}
+
+// portConfigName returns the container port of the given service port config. ex: 80/tcp.
+func portConfigName(config swarm.PortConfig) string {
+	proto := string(config.Protocol)
+	if proto == "" {
+		proto = "tcp"
+	}
+	return strconv.Itoa(int(config.TargetPort)) + "/" + proto
+}
+
+// ingressBindings returns the bindings of the given container port published by the swarm service.
+// Published ports of the routing mesh listen on all the interfaces of every node.
+// The host mode ports are listed by the service as well, they are only bound on the nodes
+// running a task and are already reported by the task container bindings: the service
+// ports published on one of the given container bindings are skipped.
+func ingressBindings(svc *swarm.Service, port string, bound []discoverclient.PortBinding) []discoverclient.PortBinding {
+	var bindings []discoverclient.PortBinding
+	for _, config := range servicePorts(svc, port) {
+		if config.PublishedPort == 0 || hostPublished(bound, int(config.PublishedPort)) {
+			continue
+		}
+		bindings = append(bindings, discoverclient.PortBinding{
+			HostIP:   "0.0.0.0",
+			HostPort: int(config.PublishedPort),
+			Protocol: docker.Port(port).Proto(),
+			Mode:     discoverclient.PublishIngress,
+		})
+	}
+	return bindings
+}
+
+// hostPublished returns whether the given host port is one of the given bindings.
+func hostPublished(bindings []discoverclient.PortBinding, hostPort int) bool {
+	for _, binding := range bindings {
+		if binding.HostPort == hostPort {
+			return true
+		}
+	}
+	return false
+}
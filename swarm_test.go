@@ -0,0 +1,162 @@
+package localdiscovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/agrarianlabs/localdiscovery/discoverclient"
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/fsouza/go-dockerclient"
+	dockertest "github.com/fsouza/go-dockerclient/testing"
+)
+
+// newSwarmServer starts a fake docker swarm manager running a single task of the given service.
+// The fake server does not set the task container network, it is served with the given IP
+// and host mode port bindings. Returns the task container ID. Call stop to release the server.
+func newSwarmServer(t *testing.T, spec swarm.ServiceSpec, ip string, ports map[docker.Port][]docker.PortBinding) (server *dockertest.DockerServer, id string, stop func()) {
+	server, stop = newFakeDocker(t)
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	if _, err := client.InitSwarm(docker.InitSwarmOptions{}); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	if _, err := client.CreateService(docker.CreateServiceOptions{ServiceSpec: spec}); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	tasks, err := client.ListTasks(docker.ListTasksOptions{})
+	if err != nil || len(tasks) != 1 {
+		stop()
+		t.Fatalf("Unexpected tasks: %v (%v)", tasks, err)
+	}
+	id = tasks[0].Status.ContainerStatus.ContainerID
+	cont, err := client.InspectContainer(id)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	cont.NetworkSettings = &docker.NetworkSettings{
+		Networks: map[string]docker.ContainerNetwork{"ingress": {IPAddress: ip}},
+		Ports:    ports,
+	}
+	server.CustomHandler("/containers/"+id+"/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(cont)
+	}))
+	return server, id, stop
+}
+
+func TestLookupPortSwarm(t *testing.T) {
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "web"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{Image: "nginx"},
+		},
+		EndpointSpec: &swarm.EndpointSpec{
+			Ports: []swarm.PortConfig{
+				{TargetPort: 80},
+				{TargetPort: 53, Protocol: swarm.PortConfigProtocolUDP, PublishedPort: 5353},
+				{TargetPort: 8080, PublishedPort: 18080}, // Host mode, bound by the task container.
+			},
+		},
+	}
+	server, id, stop := newSwarmServer(t, spec, "10.255.0.5", map[docker.Port][]docker.PortBinding{
+		"8080/tcp": {{HostIP: "0.0.0.0", HostPort: "18080"}},
+		"9000/tcp": nil,
+	})
+	defer stop()
+
+	discovery, err := NewDockerDiscovery(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = discovery.Close() }()
+
+	caller := Caller{RemoteIP: "10.255.0.5"}
+	for _, tc := range []struct {
+		port     string
+		state    discoverclient.PortState
+		bindings []discoverclient.PortBinding
+		code     discoverclient.ErrorCode
+	}{
+		{port: "80", state: discoverclient.PortPublished, bindings: []discoverclient.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: 30000, Protocol: "tcp", Mode: discoverclient.PublishIngress},
+		}},
+		{port: "53/udp", state: discoverclient.PortPublished, bindings: []discoverclient.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: 5353, Protocol: "udp", Mode: discoverclient.PublishIngress},
+		}},
+		{port: "8080", state: discoverclient.PortPublished, bindings: []discoverclient.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: 18080, Protocol: "tcp", Mode: discoverclient.PublishHost},
+		}},
+		{port: "9000", state: discoverclient.PortUnpublished, bindings: []discoverclient.PortBinding{}},
+		{port: "53", code: discoverclient.CodeNotExposed},
+	} {
+		resp, err := discovery.LookupPort(caller, tc.port)
+		if tc.code != "" {
+			if apiErr, ok := err.(*discoverclient.APIError); !ok || apiErr.Code != tc.code {
+				t.Fatalf("Unexpected error for %s.\nExpected: %s\nGot:      %v", tc.port, tc.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", tc.port, err)
+		}
+		if resp.Container != id || resp.Service != "web" || resp.State != tc.state {
+			t.Fatalf("Unexpected response for %s: %+v", tc.port, resp)
+		}
+		if !reflect.DeepEqual(resp.Bindings, tc.bindings) {
+			t.Fatalf("Unexpected bindings for %s.\nExpected: %+v\nGot:      %+v", tc.port, tc.bindings, resp.Bindings)
+		}
+	}
+
+	infos, err := discovery.ListContainers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Service != "web" || len(infos[0].Ports) != 4 {
+		t.Fatalf("Unexpected containers: %+v", infos)
+	}
+
+	// Events resolve the service as well.
+	discovery.cache.remove(id)
+	discovery.daemons[0].updateContainer(id)
+	if resp, err := discovery.LookupPort(caller, "80"); err != nil || resp.Service != "web" {
+		t.Fatalf("Unexpected response after update: %+v (%v)", resp, err)
+	}
+}
+
+func TestLookupPortSwarmLabel(t *testing.T) {
+	discovery := &DockerDiscovery{cache: newContainerCache()}
+	cont := &docker.Container{
+		ID:     "abc",
+		Config: &docker.Config{Labels: map[string]string{swarmServiceLabel: "svc"}},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]docker.ContainerNetwork{"ingress": {IPAddress: "10.255.0.6"}},
+		},
+	}
+	if ids := (&dockerDaemon{}).taskServiceIDs([]*docker.Container{cont}, false); ids["abc"] != "svc" {
+		t.Fatalf("Unexpected service IDs: %v", ids)
+	}
+	discovery.cache.setTask("", cont, &swarm.Service{
+		ID:       "svc",
+		Spec:     swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "api"}},
+		Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: 80, PublishedPort: 8000}}},
+	})
+	resp, err := discovery.LookupPort(Caller{RemoteIP: "10.255.0.6"}, "80/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Service != "api" || len(resp.Bindings) != 1 || resp.Bindings[0].HostPort != 8000 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	discovery.cache.remove("abc")
+	if svc := discovery.cache.service("abc"); svc != nil {
+		t.Fatalf("Unexpected service after removal: %v", svc)
+	}
+}